@@ -0,0 +1,311 @@
+// Package chaos stops and restarts cluster nodes on a schedule while a
+// workload runs, and reports how the workload's clients experienced each
+// outage: the burst of errors, the retries and how long it took to recover.
+//
+// Nodes are stopped and started with user-supplied shell commands, e.g.
+// `docker kill roach{node}` and `docker start roach{node}`, so the package
+// works with any local cluster.
+package chaos
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gpaul/cockroachload/clock"
+	"github.com/lib/pq"
+)
+
+// Config describes which nodes to stop, how and when.
+type Config struct {
+	// Nodes are the names substituted for {node} in the commands. They are stopped in turn.
+	Nodes []string
+	// Stop and Start are shell commands that stop and start a node.
+	Stop, Start string
+	// The first node is stopped After the schedule starts and restarted Down later.
+	// The next node is stopped Interval after the previous one, or never if Interval is 0.
+	After, Down, Interval time.Duration
+}
+
+// Validate reports whether c describes a schedule that can be run.
+func (c Config) Validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("no nodes to stop")
+	}
+	if c.Stop == "" || c.Start == "" {
+		return fmt.Errorf("both a stop and a start command are required")
+	}
+	if c.Interval != 0 && c.Interval <= c.Down {
+		return fmt.Errorf("the interval (%s) must be longer than the downtime (%s)", c.Interval, c.Down)
+	}
+	return nil
+}
+
+// command returns the shell command template with {node} replaced by node.
+func command(template, node string) string {
+	return strings.Replace(template, "{node}", node, -1)
+}
+
+// A Sample is the outcome of a single operation of the workload.
+type Sample struct {
+	Start   time.Time
+	Latency time.Duration
+	// Retries is the number of times the operation was retried before it succeeded or failed.
+	Retries int
+	Err     error
+}
+
+// An Event is a single stop and restart of a node.
+type Event struct {
+	Node             string
+	Stopped, Started time.Time
+	// Err is the error of the stop or start command, if any.
+	Err error
+}
+
+// A Report describes how the workload fared from the moment a node was stopped until the next node was stopped.
+type Report struct {
+	Event
+	Operations, Errors, Retries int
+	FirstError, LastError       time.Time
+	MaxLatency                  time.Duration
+	// Recovery is the time from stopping the node until the first successful operation after the last error.
+	// It is 0 if there were no errors.
+	Recovery time.Duration
+	// Recovered is false if no operation succeeded after the last error.
+	Recovered bool
+}
+
+func (r Report) String() string {
+	downtime := "still down"
+	if !r.Started.IsZero() {
+		downtime = fmt.Sprintf("down for %s", r.Started.Sub(r.Stopped))
+	}
+	s := fmt.Sprintf("node %s %s: %d operations, %d errors, %d retries, max latency %s",
+		r.Node, downtime, r.Operations, r.Errors, r.Retries, r.MaxLatency)
+	if r.Errors > 0 {
+		s += fmt.Sprintf(", errors from +%s to +%s", r.FirstError.Sub(r.Stopped), r.LastError.Sub(r.Stopped))
+		if r.Recovered {
+			s += fmt.Sprintf(", recovered after %s", r.Recovery)
+		} else {
+			s += ", not recovered"
+		}
+	}
+	if r.Err != nil {
+		s += fmt.Sprintf(", command failed: %v", r.Err)
+	}
+	return s
+}
+
+// Analyze summarizes the samples that started in [e.Stopped, until).
+func Analyze(e Event, samples []Sample, until time.Time) Report {
+	r := Report{Event: e}
+	var recovered time.Time
+	for _, s := range samples {
+		if s.Start.Before(e.Stopped) || !s.Start.Before(until) {
+			continue
+		}
+		r.Operations++
+		r.Retries += s.Retries
+		if s.Latency > r.MaxLatency {
+			r.MaxLatency = s.Latency
+		}
+		end := s.Start.Add(s.Latency)
+		if s.Err != nil {
+			r.Errors++
+			if r.FirstError.IsZero() || s.Start.Before(r.FirstError) {
+				r.FirstError = s.Start
+			}
+			if end.After(r.LastError) {
+				r.LastError = end
+			}
+		}
+	}
+	if r.Errors == 0 {
+		return r
+	}
+	for _, s := range samples {
+		if s.Err != nil || s.Start.Before(e.Stopped) || !s.Start.Before(until) {
+			continue
+		}
+		end := s.Start.Add(s.Latency)
+		if end.After(r.LastError) && (recovered.IsZero() || end.Before(recovered)) {
+			recovered = end
+		}
+	}
+	if !recovered.IsZero() {
+		r.Recovered = true
+		r.Recovery = recovered.Sub(e.Stopped)
+	}
+	return r
+}
+
+// Transient reports whether err is the kind of error a client sees while a node is down,
+// as opposed to an error in the workload itself.
+func Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback, including retryable errors
+			"57", // operator intervention, e.g. the node is shutting down
+			"58", // system error
+			"XX": // internal error, e.g. a range that is temporarily unavailable
+			return true
+		}
+		return false
+	}
+	// lib/pq reports some failures of the underlying connection as plain errors.
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+// A Monkey runs a schedule of node stops and restarts and records the workload's operations meanwhile.
+type Monkey struct {
+	cfg   Config
+	logf  func(format string, args ...interface{})
+	clock clock.Clock
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	mu      sync.Mutex
+	samples []Sample
+	current *Event
+	reports []Report
+}
+
+// Start runs cfg's schedule in the background, logging each event with logf.
+func Start(cfg Config, logf func(format string, args ...interface{})) (*Monkey, error) {
+	return start(cfg, logf, clock.Real)
+}
+
+// start is Start with the schedule timed by c.
+func start(cfg Config, logf func(format string, args ...interface{}), c clock.Clock) (*Monkey, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	m := &Monkey{cfg: cfg, logf: logf, clock: c, stop: make(chan struct{}), done: make(chan struct{})}
+	go m.run()
+	return m, nil
+}
+
+// Record adds the outcome of an operation. It is safe for concurrent use.
+func (m *Monkey) Record(s Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil && len(m.reports) == 0 {
+		// Nothing has happened yet, so there is nothing to compare against.
+		return
+	}
+	m.samples = append(m.samples, s)
+}
+
+// Stop cancels the rest of the schedule, restarts a node that is down and returns a report for every event.
+// It may be called more than once.
+func (m *Monkey) Stop() []Report {
+	m.once.Do(func() { close(m.stop) })
+	<-m.done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finishEvent(m.clock.Now())
+	return m.reports
+}
+
+// RunInterruptible runs fn until it returns or the program is interrupted, whichever happens first.
+// An interrupt returns an error right away, so that the caller shuts down as it does after any other
+// error: it stops its Monkey, which restarts a node that is down, and flushes what it reports.
+// fn is left running until the program exits.
+func RunInterruptible(fn func() error) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	return runInterruptible(fn, interrupt)
+}
+
+func runInterruptible(fn func() error, interrupt <-chan os.Signal) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-interrupt:
+		return fmt.Errorf("interrupted by %s", sig)
+	}
+}
+
+// sleep waits for d and returns false if the monkey was stopped first.
+func (m *Monkey) sleep(d time.Duration) bool {
+	select {
+	case <-m.clock.After(d):
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+func (m *Monkey) run() {
+	defer close(m.done)
+	if !m.sleep(m.cfg.After) {
+		return
+	}
+	for i := 0; ; i++ {
+		node := m.cfg.Nodes[i%len(m.cfg.Nodes)]
+		next := m.clock.Now().Add(m.cfg.Interval)
+		m.mu.Lock()
+		m.finishEvent(m.clock.Now())
+		m.current = &Event{Node: node, Stopped: m.clock.Now()}
+		m.mu.Unlock()
+		m.logf("Stopping node %s", node)
+		err := m.exec(command(m.cfg.Stop, node))
+		// Restart the node even if the monkey is stopped in the meantime, so the cluster is left intact.
+		m.sleep(m.cfg.Down)
+		m.logf("Starting node %s", node)
+		if serr := m.exec(command(m.cfg.Start, node)); err == nil {
+			err = serr
+		}
+		m.mu.Lock()
+		m.current.Started = m.clock.Now()
+		m.current.Err = err
+		m.mu.Unlock()
+		if m.cfg.Interval == 0 || !m.sleep(next.Sub(m.clock.Now())) {
+			return
+		}
+	}
+}
+
+func (m *Monkey) exec(cmd string) error {
+	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", cmd, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// finishEvent reports on the current event, if any, and forgets its samples. m.mu must be held.
+func (m *Monkey) finishEvent(now time.Time) {
+	if m.current == nil {
+		return
+	}
+	r := Analyze(*m.current, m.samples, now)
+	m.logf("Chaos event %d: %s", len(m.reports)+1, r)
+	m.reports = append(m.reports, r)
+	m.current = nil
+	m.samples = nil
+}
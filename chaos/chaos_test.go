@@ -0,0 +1,187 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/clock"
+	"github.com/lib/pq"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Config{Nodes: []string{"1"}, Stop: "true", Start: "true", Down: time.Second}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+	for _, c := range []Config{
+		{Stop: "true", Start: "true"},
+		{Nodes: []string{"1"}, Stop: "true"},
+		{Nodes: []string{"1"}, Stop: "true", Start: "true", Down: time.Second, Interval: time.Second},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("invalid config %+v accepted", c)
+		}
+	}
+}
+
+func TestTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("pq: duplicate key value"), false},
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("dial tcp 127.0.0.1:26257: connect: connection refused"), true},
+	} {
+		if got := Transient(tc.err); got != tc.want {
+			t.Errorf("Transient(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	base := time.Now()
+	at := func(d time.Duration) time.Time { return base.Add(d) }
+	failed := errors.New("failed")
+	e := Event{Node: "2", Stopped: base, Started: at(10 * time.Second)}
+	samples := []Sample{
+		{Start: at(-time.Second), Latency: time.Millisecond, Err: failed}, // before the event
+		{Start: at(time.Second), Latency: time.Second, Err: failed},
+		{Start: at(2 * time.Second), Latency: 3 * time.Second, Retries: 2},
+		{Start: at(5 * time.Second), Latency: time.Second, Err: failed},
+		{Start: at(7 * time.Second), Latency: time.Second, Retries: 1},
+		{Start: at(9 * time.Second), Latency: time.Millisecond},
+		{Start: at(time.Minute), Latency: time.Millisecond, Err: failed}, // after the report
+	}
+	r := Analyze(e, samples, at(30*time.Second))
+	if r.Operations != 5 || r.Errors != 2 || r.Retries != 3 || r.MaxLatency != 3*time.Second {
+		t.Errorf("unexpected totals in %s", r)
+	}
+	if r.FirstError != at(time.Second) || r.LastError != at(6*time.Second) {
+		t.Errorf("unexpected error burst in %s", r)
+	}
+	if !r.Recovered || r.Recovery != 8*time.Second {
+		t.Errorf("unexpected recovery in %s", r)
+	}
+
+	r = Analyze(e, samples[:4], at(30*time.Second))
+	if r.Recovered {
+		t.Errorf("recovered without a success after the last error: %s", r)
+	}
+	r = Analyze(e, nil, at(30*time.Second))
+	if r.Errors != 0 || r.Recovery != 0 {
+		t.Errorf("unexpected report without samples: %s", r)
+	}
+}
+
+func readLog(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+func newLoggingConfig(t *testing.T) (Config, string, func()) {
+	dir, err := ioutil.TempDir("", "chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "log")
+	cfg := Config{
+		Nodes: []string{"a", "b"},
+		Stop:  fmt.Sprintf("echo stop-{node} >> %s", log),
+		Start: fmt.Sprintf("echo start-{node} >> %s", log),
+	}
+	return cfg, log, func() { os.RemoveAll(dir) }
+}
+
+func TestMonkeySchedule(t *testing.T) {
+	cfg, log, cleanup := newLoggingConfig(t)
+	defer cleanup()
+	cfg.Down = 50 * time.Millisecond
+	cfg.Interval = 200 * time.Millisecond
+	c := clock.NewManual(time.Unix(0, 0))
+	m, err := start(cfg, t.Logf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each node is stopped, then the monkey waits for its downtime to pass, starts it and waits for the interval to pass.
+	for _, step := range []time.Duration{cfg.Down, cfg.Interval - cfg.Down, cfg.Down} {
+		c.WaitForTimers(1)
+		c.Advance(step)
+	}
+	c.WaitForTimers(1)
+	reports := m.Stop()
+	if got, want := readLog(t, log), "stop-a start-a stop-b start-b"; got != want {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if len(reports) != 2 || reports[0].Node != "a" || reports[1].Node != "b" {
+		t.Fatalf("unexpected reports %v", reports)
+	}
+	if down := reports[1].Started.Sub(reports[1].Stopped); down != cfg.Down {
+		t.Errorf("node b was down for %s, want %s", down, cfg.Down)
+	}
+}
+
+func TestMonkeyStopRestartsNode(t *testing.T) {
+	cfg, log, cleanup := newLoggingConfig(t)
+	defer cleanup()
+	cfg.Down = time.Hour
+	c := clock.NewManual(time.Unix(0, 0))
+	m, err := start(cfg, t.Logf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once node a is stopped, the monkey waits for its downtime to pass.
+	c.WaitForTimers(1)
+	m.Record(Sample{Start: c.Now(), Err: errors.New("failed")})
+	c.Advance(time.Minute)
+	reports := m.Stop()
+	if got, want := readLog(t, log), "stop-a start-a"; got != want {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if len(reports) != 1 || reports[0].Errors != 1 || reports[0].Started.IsZero() {
+		t.Errorf("unexpected reports %v", reports)
+	}
+}
+
+func TestMonkeyReportsFailedCommand(t *testing.T) {
+	c := clock.NewManual(time.Unix(0, 0))
+	m, err := start(Config{Nodes: []string{"a"}, Stop: "false", Start: "true", Down: time.Hour}, t.Logf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForTimers(1)
+	reports := m.Stop()
+	if len(reports) != 1 || reports[0].Err == nil {
+		t.Errorf("failed stop command not reported: %v", reports)
+	}
+}
+
+func TestRunInterruptible(t *testing.T) {
+	failed := errors.New("failed")
+	if err := runInterruptible(func() error { return failed }, nil); err != failed {
+		t.Errorf("runInterruptible() = %v, want the function's error", err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+	release := make(chan struct{})
+	defer close(release)
+	err := runInterruptible(func() error { <-release; return nil }, interrupt)
+	if err == nil || !strings.Contains(err.Error(), "interrupt") {
+		t.Errorf("runInterruptible() after an interrupt = %v, want an error", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Package clock tells the time for the schedules of faults and node outages.
+// Tests replace the real clock with a Manual one and step through a schedule
+// instead of sleeping through it.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Manual is a Clock that only moves when it is advanced.
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []timer
+	changed chan struct{} // closed and replaced whenever a timer is added
+}
+
+type timer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewManual returns a Manual clock set to now.
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now, changed: make(chan struct{})}
+}
+
+func (c *Manual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Manual) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, timer{at: c.now.Add(d), c: ch})
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the timers that are due.
+func (c *Manual) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []timer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// WaitForTimers blocks until n timers are pending, that is until the code under test waits for the clock in n places.
+func (c *Manual) WaitForTimers(n int) {
+	for {
+		c.mu.Lock()
+		pending, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
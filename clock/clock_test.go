@@ -0,0 +1,31 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewManual(start)
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("a timer for no time at all didn't fire right away")
+	}
+	fired := c.After(time.Second)
+	c.WaitForTimers(1)
+	c.Advance(time.Second - 1)
+	select {
+	case <-fired:
+		t.Fatal("the timer fired early")
+	default:
+	}
+	c.Advance(1)
+	if at := <-fired; !at.Equal(start.Add(time.Second)) {
+		t.Errorf("the timer fired at %s, want %s", at, start.Add(time.Second))
+	}
+	if now := c.Now(); !now.Equal(start.Add(time.Second)) {
+		t.Errorf("Now() = %s after advancing a second", now)
+	}
+}
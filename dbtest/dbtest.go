@@ -0,0 +1,49 @@
+// Package dbtest connects tests to a database: either a pgfake server answering from a handler,
+// or a single-node CockroachDB cluster started from a local binary. Everything it starts is
+// stopped when the test finishes.
+package dbtest
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach-go/testserver"
+	"github.com/gpaul/cockroachload/pgfake"
+	_ "github.com/lib/pq"
+)
+
+// Fake serves handler from a pgfake server and connects to it.
+func Fake(t testing.TB, handler pgfake.Handler) (*sql.DB, *pgfake.Server) {
+	server, err := pgfake.NewServer(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	db, err := sql.Open("postgres", server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, server
+}
+
+// Cockroach starts a single-node cluster using the cockroach binary named by $COCKROACH_BINARY
+// and connects to its testdb database. The test is skipped if no binary is supplied.
+func Cockroach(t *testing.T) *sql.DB {
+	binary := os.Getenv("COCKROACH_BINARY")
+	if binary == "" {
+		t.Skip("COCKROACH_BINARY is not set")
+	}
+	if _, err := os.Stat(binary); err != nil {
+		t.Skipf("cockroach binary unavailable: %v", err)
+	}
+	// Setting the binary explicitly keeps testserver from downloading one.
+	if err := flag.Set("cockroach-binary", binary); err != nil {
+		t.Fatal(err)
+	}
+	db, stop := testserver.NewDBForTestWithDatabase(t, "testdb")
+	t.Cleanup(stop)
+	return db
+}
@@ -0,0 +1,251 @@
+// Package discovery connects to a cluster whose nodes are listed in a file
+// rather than given on the command line. The file is watched for changes:
+// connections to nodes that are removed from it are drained once they are
+// no longer in use, and new connections are spread round-robin over the nodes
+// currently listed, so nodes can come and go without restarting the workload.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ParseNodes parses a node list: either a JSON array of "host:port" strings, or one "host:port" per line.
+// Empty lines and lines starting with # are ignored.
+func ParseNodes(data []byte) ([]string, error) {
+	var nodes []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &nodes); err != nil {
+			return nil, fmt.Errorf("invalid JSON node list: %v", err)
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			nodes = append(nodes, line)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes listed")
+	}
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		if !strings.Contains(node, ":") {
+			return nil, fmt.Errorf("invalid node %q: must be host:port", node)
+		}
+		if seen[node] {
+			return nil, fmt.Errorf("node %s is listed twice", node)
+		}
+		seen[node] = true
+	}
+	return nodes, nil
+}
+
+// Nodes is the current list of nodes in a watched file.
+type Nodes struct {
+	path string
+	logf func(format string, args ...interface{})
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	list    []string
+	next    int
+	modTime time.Time
+	size    int64
+}
+
+// Watch reads the node list in path and rereads it whenever it changes, checking every interval.
+// An invalid or empty list is logged with logf and the previous list is kept.
+func Watch(path string, interval time.Duration, logf func(format string, args ...interface{})) (*Nodes, error) {
+	n := &Nodes{path: path, logf: logf, stop: make(chan struct{}), done: make(chan struct{})}
+	if _, err := n.reload(); err != nil {
+		return nil, err
+	}
+	go n.watch(interval)
+	return n, nil
+}
+
+// Close stops watching the file.
+func (n *Nodes) Close() {
+	close(n.stop)
+	<-n.done
+}
+
+// List returns the nodes currently listed.
+func (n *Nodes) List() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.list...)
+}
+
+// Contains reports whether node is currently listed.
+func (n *Nodes) Contains(node string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, listed := range n.list {
+		if listed == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the nodes in turn.
+func (n *Nodes) Next() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	node := n.list[n.next%len(n.list)]
+	n.next++
+	return node
+}
+
+func (n *Nodes) watch(interval time.Duration) {
+	defer close(n.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := n.reload(); err != nil {
+				n.logf("Keeping the previous node list: %v", err)
+			}
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// reload rereads the file if it changed since it was last read and reports whether the node list changed.
+func (n *Nodes) reload() (bool, error) {
+	info, err := os.Stat(n.path)
+	if err != nil {
+		return false, err
+	}
+	n.mu.Lock()
+	unchanged := info.ModTime().Equal(n.modTime) && info.Size() == n.size
+	n.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(n.path)
+	if err != nil {
+		return false, err
+	}
+	list, err := ParseNodes(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", n.path, err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.modTime, n.size = info.ModTime(), info.Size()
+	added, removed := diff(n.list, list)
+	if len(added) == 0 && len(removed) == 0 {
+		return false, nil
+	}
+	if n.list != nil {
+		n.logf("Node list changed: added %v, removed %v", added, removed)
+	}
+	n.list = list
+	return true, nil
+}
+
+// diff returns the nodes in to that are not in from and vice versa.
+func diff(from, to []string) (added, removed []string) {
+	in := func(list []string, node string) bool {
+		for _, n := range list {
+			if n == node {
+				return true
+			}
+		}
+		return false
+	}
+	for _, node := range to {
+		if !in(from, node) {
+			added = append(added, node)
+		}
+	}
+	for _, node := range from {
+		if !in(to, node) {
+			removed = append(removed, node)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// OpenDB returns a database whose connections are opened to nodes in turn.
+// dsn returns the lib/pq connection string for a node.
+// A connection to a node that is no longer listed is closed instead of being reused.
+func OpenDB(nodes *Nodes, dsn func(node string) string) *sql.DB {
+	return sql.OpenDB(&connector{nodes: nodes, dsn: dsn})
+}
+
+type connector struct {
+	nodes *Nodes
+	dsn   func(node string) string
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	node := c.nodes.Next()
+	cn, err := pq.Open(c.dsn(node))
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: cn, node: node, nodes: c.nodes}, nil
+}
+
+func (c *connector) Driver() driver.Driver { return &pq.Driver{} }
+
+// conn is a lib/pq connection to a listed node.
+type conn struct {
+	driver.Conn
+	node  string
+	nodes *Nodes
+}
+
+// ResetSession is called before a pooled connection is reused.
+func (c *conn) ResetSession(context.Context) error {
+	if !c.nodes.Contains(c.node) {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// IsValid is called before a connection is returned to the pool.
+func (c *conn) IsValid() bool { return c.nodes.Contains(c.node) }
+
+func (c *conn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.Conn.(driver.Queryer).Query(query, args)
+}
+
+func (c *conn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.Conn.(driver.Execer).Exec(query, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/pgfake"
+)
+
+func TestParseNodes(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want []string
+	}{
+		{"localhost:26257\n", []string{"localhost:26257"}},
+		{"# staging\nnode1:26257\n\n  node2:26257  \n", []string{"node1:26257", "node2:26257"}},
+		{`["node1:26257", "node2:26257"]`, []string{"node1:26257", "node2:26257"}},
+		{"\n  [\"node1:26257\"]\n", []string{"node1:26257"}},
+	} {
+		got, err := ParseNodes([]byte(tc.data))
+		if err != nil {
+			t.Errorf("ParseNodes(%q) failed: %v", tc.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseNodes(%q) = %v, want %v", tc.data, got, tc.want)
+		}
+	}
+	for _, data := range []string{"", "# nothing\n", "[]", `["node1:26257"`, "node1\n", "node1:26257\nnode1:26257\n"} {
+		if nodes, err := ParseNodes([]byte(data)); err == nil {
+			t.Errorf("ParseNodes(%q) = %v, want an error", data, nodes)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	added, removed := diff([]string{"a", "b", "c"}, []string{"d", "b", "a"})
+	if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"c"}) {
+		t.Errorf("diff() = %v, %v", added, removed)
+	}
+}
+
+// nodesFile is a temporary node list.
+type nodesFile struct {
+	t    *testing.T
+	dir  string
+	path string
+}
+
+func newNodesFile(t *testing.T, nodes ...string) *nodesFile {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &nodesFile{t: t, dir: dir, path: filepath.Join(dir, "nodes")}
+	f.write(nodes...)
+	return f
+}
+
+// write replaces the node list, making sure the file's modification time changes.
+func (f *nodesFile) write(nodes ...string) {
+	data := ""
+	for _, node := range nodes {
+		data += node + "\n"
+	}
+	if err := ioutil.WriteFile(f.path, []byte(data), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	future := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(f.path, future, future); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *nodesFile) remove() { os.RemoveAll(f.dir) }
+
+// waitFor polls until n lists want.
+func waitFor(t *testing.T, n *Nodes, want ...string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if reflect.DeepEqual(n.List(), want) {
+			return
+		}
+	}
+	t.Fatalf("node list is %v, want %v", n.List(), want)
+}
+
+func TestWatch(t *testing.T) {
+	f := newNodesFile(t, "a:1", "b:2")
+	defer f.remove()
+	n, err := Watch(f.path, 5*time.Millisecond, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if got := []string{n.Next(), n.Next(), n.Next()}; !reflect.DeepEqual(got, []string{"a:1", "b:2", "a:1"}) {
+		t.Errorf("Next() returned %v", got)
+	}
+	f.write("b:2", "c:3")
+	waitFor(t, n, "b:2", "c:3")
+	if n.Contains("a:1") || !n.Contains("c:3") {
+		t.Errorf("Contains() disagrees with %v", n.List())
+	}
+	// An invalid list is ignored.
+	f.write("# nothing")
+	time.Sleep(50 * time.Millisecond)
+	waitFor(t, n, "b:2", "c:3")
+}
+
+func TestWatchMissingFile(t *testing.T) {
+	if _, err := Watch(filepath.Join(os.TempDir(), "does-not-exist"), time.Second, t.Logf); err == nil {
+		t.Error("watching a missing file succeeded")
+	}
+}
+
+func newServer(t *testing.T) *pgfake.Server {
+	s, err := pgfake.NewServer(pgfake.NewScript(pgfake.Rule{Pattern: "^SELECT", Result: pgfake.Result{Columns: []string{"one"}, Rows: [][]interface{}{{1}}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOpenDBDrainsRemovedNodes(t *testing.T) {
+	a, b := newServer(t), newServer(t)
+	defer a.Close()
+	defer b.Close()
+	f := newNodesFile(t, a.Addr())
+	defer f.remove()
+	n, err := Watch(f.path, 5*time.Millisecond, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	db := OpenDB(n, func(node string) string {
+		return fmt.Sprintf("postgresql://root@%s/testdb?sslmode=disable", node)
+	})
+	defer db.Close()
+
+	query := func() {
+		var one int
+		if err := db.QueryRow("SELECT 1").Scan(&one); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query()
+	// A transaction that is open while its node is removed completes on that node.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.write(b.Addr())
+	waitFor(t, n, b.Addr())
+	if _, err := tx.Exec("SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	query()
+	query()
+	if got := len(a.Queries()); got != 4 {
+		t.Errorf("removed node executed %d statements, want 4: %v", got, a.Queries())
+	}
+	if got := len(b.Queries()); got != 2 {
+		t.Errorf("new node executed %d statements, want 2: %v", got, b.Queries())
+	}
+}
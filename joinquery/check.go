@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math/rand"
+	"strings"
+
+	"github.com/gpaul/cockroachload/queries"
+)
+
+var checkHitRatio float64
+
+var actions = []string{"create", "read", "update", "delete"}
+
+type triple struct {
+	uid, rid, action string
+}
+
+// checkQuery performs point authorization checks for (user, resource, action) triples drawn from the loaded data.
+type checkQuery struct {
+	uids    []string
+	rids    []string
+	granted []triple
+	allowed map[triple]bool
+
+	checks, hits, misses, unexpected int
+}
+
+func newCheckQuery(db *sql.DB) (query, error) {
+	c := &checkQuery{allowed: map[triple]bool{}}
+	var err error
+	if c.uids, err = queryStrings(db, "SELECT uid from users"); err != nil {
+		return nil, err
+	}
+	if c.rids, err = queryStrings(db, "SELECT rid from resources"); err != nil {
+		return nil, err
+	}
+	// Expand direct and group-inherited grants so that the expected outcome of every check is known up front.
+	rows, err := db.Query(`SELECT users.uid, resources.rid, aces.actions FROM aces JOIN users ON users.id = aces.user_id JOIN resources ON resources.id = aces.resource_id
+UNION ALL
+SELECT users.uid, resources.rid, aces.actions FROM aces JOIN user_groups ON user_groups.group_id = aces.group_id JOIN users ON users.id = user_groups.user_id JOIN resources ON resources.id = aces.resource_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid, rid, actionstr string
+		if err := rows.Scan(&uid, &rid, &actionstr); err != nil {
+			return nil, err
+		}
+		for _, action := range strings.Split(actionstr, ",") {
+			t := triple{uid, rid, action}
+			if !c.allowed[t] {
+				c.allowed[t] = true
+				c.granted = append(c.granted, t)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d users, %d resources and %d granted (user, resource, action) triples for authorization checks", len(c.uids), len(c.rids), len(c.granted))
+	return c.run, nil
+}
+
+// next returns a triple that is granted with probability checkHitRatio.
+func (c *checkQuery) next() (t triple, ok bool) {
+	if len(c.granted) > 0 && rand.Float64() < checkHitRatio {
+		return c.granted[rand.Intn(len(c.granted))], true
+	}
+	if len(c.uids) == 0 || len(c.rids) == 0 {
+		return t, false
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		t = triple{c.uids[rand.Intn(len(c.uids))], c.rids[rand.Intn(len(c.rids))], actions[rand.Intn(len(actions))]}
+		if !c.allowed[t] {
+			return t, true
+		}
+	}
+	// Everything we tried is granted; no loaded user is ever granted this action.
+	t.action = "none"
+	return t, true
+}
+
+func (c *checkQuery) run(db *sql.DB) (bool, error) {
+	t, ok := c.next()
+	if !ok {
+		return false, nil
+	}
+	allowed, err := checkAccess(db, t.uid, t.rid, t.action)
+	if err != nil {
+		return false, err
+	}
+	c.checks++
+	if allowed {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	if allowed != c.allowed[t] {
+		c.unexpected++
+		log.Printf("Unexpected authorization result for user %s, resource %s, action %s: allowed=%t", t.uid, t.rid, t.action, allowed)
+	}
+	if c.checks%100 == 0 {
+		log.Printf("Authorization checks: %d total, %d allowed, %d denied, %d unexpected", c.checks, c.hits, c.misses, c.unexpected)
+	}
+	return true, nil
+}
+
+// checkAccess answers "can user uid perform action on resource rid?" taking group-inherited grants into account.
+func checkAccess(db *sql.DB, uid, rid, action string) (bool, error) {
+	rows, err := queryDB(db, queries.CheckAccess, uid, rid)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	allowed := false
+	for rows.Next() {
+		var actionstr string
+		if err := rows.Scan(&actionstr); err != nil {
+			return false, err
+		}
+		for _, a := range strings.Split(actionstr, ",") {
+			if a == action {
+				allowed = true
+			}
+		}
+	}
+	return allowed, rows.Err()
+}
+
+func queryStrings(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"github.com/gpaul/cockroachload/queries"
+)
+
+// explainedStatements are the statements of each query mode whose plans -explain reports, along with sample arguments
+// that match the data produced by load.
+var explainedStatements = map[string][]struct {
+	sql  string
+	args []interface{}
+}{
+	"acl":        {{queries.UserACL, []interface{}{"0"}}},
+	"check":      {{queries.CheckAccess, []interface{}{"0", "user-resource-0"}}},
+	"principals": {{queries.ResourcePrincipals, []interface{}{"user-resource-0"}}},
+	"list":       {{"SELECT uid FROM users WHERE uid > $1 ORDER BY uid LIMIT $2", []interface{}{"", 100}}},
+}
+
+// explainQueries logs the plan of every statement issued by the given query modes and whether the plan contains an index join,
+// i.e. whether the indexes it scans store every column the statement needs.
+func explainQueries(db *sql.DB, modes []string) error {
+	for _, mode := range modes {
+		for _, stmt := range explainedStatements[mode] {
+			plan, err := explain(db, stmt.sql, stmt.args...)
+			if err != nil {
+				return err
+			}
+			indexJoin := strings.Contains(plan, "index-join") || strings.Contains(plan, "index join")
+			log.Printf("Plan for %s query:\n%s\n", mode, plan)
+			if indexJoin {
+				log.Printf("Query %s performs an index join\n", mode)
+			} else {
+				log.Printf("Query %s avoids index joins\n", mode)
+			}
+		}
+	}
+	return nil
+}
+
+// explain returns the rows produced by EXPLAIN for the statement, one line per row with tab-separated columns.
+func explain(db *sql.DB, query string, args ...interface{}) (string, error) {
+	rows, err := db.Query("EXPLAIN "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for idx := range values {
+			dest[idx] = &values[idx]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		fields := make([]string, len(values))
+		for idx, v := range values {
+			fields[idx] = v.String
+		}
+		lines = append(lines, strings.Join(fields, "\t"))
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/gpaul/cockroachload/dbtest"
+	"github.com/gpaul/cockroachload/pgfake"
+	"github.com/gpaul/cockroachload/queries"
+)
+
+// newFakeDB serves rules from a pgfake server and connects to it.
+func newFakeDB(t *testing.T, rules ...pgfake.Rule) (*sql.DB, *pgfake.Server) {
+	return dbtest.Fake(t, pgfake.NewScript(rules...))
+}
+
+func TestCheckAccessScripted(t *testing.T) {
+	defer func(mode string) { statementMode = mode }(statementMode)
+	// The three checks run one after the other on the same connection.
+	for mode, prepares := range map[string]int{"adhoc": 3, "conn": 1} {
+		t.Run(mode, func(t *testing.T) {
+			statementMode = mode
+			db, server := newFakeDB(t,
+				pgfake.Rule{Pattern: `^SELECT aces.actions FROM aces`, Result: pgfake.Result{Columns: []string{"actions"}, Rows: [][]interface{}{{"create"}, {"read,update"}}}},
+			)
+			for action, want := range map[string]bool{"create": true, "update": true, "delete": false} {
+				got, err := checkAccess(db, "0", "user-resource-0", action)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("checkAccess(%s) = %t, want %t", action, got, want)
+				}
+			}
+			if got := server.Prepared()[queries.CheckAccess]; got != prepares {
+				t.Errorf("the check was prepared %d times, want %d", got, prepares)
+			}
+		})
+	}
+}
+
+func TestPrepareStatements(t *testing.T) {
+	defer func(mode string) { statementMode = mode }(statementMode)
+	statementMode = "conn"
+	db, server := newFakeDB(t, pgfake.Rule{Pattern: ".", Result: pgfake.Result{Columns: []string{"actions"}}})
+	var modes []string
+	for mode := range queryModes {
+		modes = append(modes, mode)
+	}
+	if err := prepareStatements(db, modes); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range modes {
+		for _, query := range queryStatements[mode]() {
+			if got := server.Prepared()[query]; got != 1 {
+				t.Errorf("%q was prepared %d times, want once", query, got)
+			}
+		}
+	}
+	// The check reuses the statement prepared up front.
+	if _, err := checkAccess(db, "0", "user-resource-0", "read"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Prepared()[queries.CheckAccess]; got != 1 {
+		t.Errorf("the check was prepared %d times, want once", got)
+	}
+}
+
+func TestQueryListStopsAtShortPage(t *testing.T) {
+	defer func(size int) { pageSize = size }(pageSize)
+	pageSize = 2
+	full := pgfake.Result{Columns: []string{"id"}, Rows: [][]interface{}{{"a"}, {"b"}}}
+	short := pgfake.Result{Columns: []string{"id"}, Rows: [][]interface{}{{"c"}}}
+	var rules []pgfake.Rule
+	for _, lt := range listedTables {
+		for _, style := range []string{"OFFSET", "WHERE"} {
+			pattern := "FROM " + lt.table + " .*" + style
+			rules = append(rules,
+				pgfake.Rule{Pattern: pattern, Result: full, Times: 1},
+				pgfake.Rule{Pattern: pattern, Result: short, Times: 1},
+			)
+		}
+	}
+	script := pgfake.NewScript(rules...)
+	db, _ := dbtest.Fake(t, script)
+	if ok, err := queryList(db); err != nil || !ok {
+		t.Fatalf("queryList() = %t, %v", ok, err)
+	}
+	if unused := script.Unused(); len(unused) > 0 {
+		t.Errorf("unused rules: %v", unused)
+	}
+}
+
+func TestQueryUserACLRetriesAfterDroppedConnection(t *testing.T) {
+	db, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT users.uid as uid from users$`, CloseConn: true, Times: 1},
+		pgfake.Rule{Pattern: `^SELECT users.uid as uid from users$`, Result: pgfake.Result{Columns: []string{"uid"}, Rows: [][]interface{}{{"0"}}}},
+		pgfake.Rule{Pattern: `^SELECT resources.id AS resources_id`, Result: pgfake.Result{Columns: []string{"resources_id"}, Rows: [][]interface{}{{1}}}},
+	)
+	if ok, err := queryUserACL(db); err != nil || !ok {
+		t.Fatalf("queryUserACL() = %t, %v", ok, err)
+	}
+}
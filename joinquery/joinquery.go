@@ -11,6 +11,10 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/gpaul/cockroachload/chaos"
+	"github.com/gpaul/cockroachload/discovery"
+	"github.com/gpaul/cockroachload/pool"
+	"github.com/gpaul/cockroachload/queries"
 )
 
 func allowGroupAccessToResource(db *sql.DB, groupid, resourceid int) error {
@@ -23,43 +27,103 @@ func allowGroupAccessToResource(db *sql.DB, groupid, resourceid int) error {
 	})
 }
 
-func performQueries(db *sql.DB) error {
-	t := time.Now()
-	for ii := 0; ; ii++ {
-		rows, err := db.Query("SELECT users.uid as uid from users")
+// A query is a single read pattern that is benchmarked by performQueries.
+// It returns false if there was nothing to query, in which case the attempt is not timed.
+type query func(db *sql.DB) (ok bool, err error)
+
+// queryModes maps the names accepted by -queries to a function that prepares the corresponding query.
+var queryModes = map[string]func(db *sql.DB) (query, error){
+	"acl":        func(*sql.DB) (query, error) { return queryUserACL, nil },
+	"check":      newCheckQuery,
+	"list":       func(*sql.DB) (query, error) { return queryList, nil },
+	"principals": newResourcePrincipalsQuery,
+}
+
+// queryStatements maps each query mode to the statements its query runs.
+var queryStatements = map[string]func() []string{
+	"acl":        func() []string { return []string{userUIDsQuery, queries.UserACL} },
+	"check":      func() []string { return []string{queries.CheckAccess} },
+	"list":       listStatements,
+	"principals": func() []string { return []string{queries.ResourcePrincipals} },
+}
+
+// chaosMonkey is set while nodes are stopped and restarted during the queries.
+// Queries that fail because a node is down are then reported instead of ending the run.
+var chaosMonkey *chaos.Monkey
+
+func performQueries(db *sql.DB, modes []string) error {
+	queries := make([]query, len(modes))
+	for idx, mode := range modes {
+		newQuery, ok := queryModes[mode]
+		if !ok {
+			return fmt.Errorf("unknown query mode %q", mode)
+		}
+		q, err := newQuery(db)
 		if err != nil {
 			return err
 		}
-		userids := []string{}
-		for rows.Next() {
-			var userid string
-			if err := rows.Scan(&userid); err != nil {
+		queries[idx] = q
+	}
+	if err := prepareStatements(db, modes); err != nil {
+		return err
+	}
+	for ii := 0; ; ii++ {
+		for idx, q := range queries {
+			t := time.Now()
+			ok, err := q(db)
+			elapsed := time.Since(t)
+			if chaosMonkey != nil {
+				chaosMonkey.Record(chaos.Sample{Start: t, Latency: elapsed, Err: err})
+				if chaos.Transient(err) {
+					log.Printf("Query %d (%s) failed after %s: %v\n", ii+1, modes[idx], elapsed, err)
+					continue
+				}
+			}
+			if err != nil {
 				return err
 			}
-			userids = append(userids, userid)
-		}
-		if rows.Err() != nil {
-			return err
-		}
-		if len(userids) == 0 {
-			continue
-		}
-		userid := userids[rand.Intn(len(userids))]
-		rows, err = db.Query("SELECT resources.id AS resources_id, resources.rid AS resources_rid, resources.description AS resources_description, aces.actions AS aces_actions, aces.id AS aces_id, aces.user_id AS aces_user_id, aces.group_id AS aces_group_id, aces.resource_id AS aces_resource_id FROM aces JOIN users ON users.id = aces.user_id JOIN resources ON resources.id = aces.resource_id WHERE users.uid = $1", userid)
-		if err != nil {
-			return err
-		}
-		for rows.Next() {
-			// we ignore the actual data but iterate over the rows to make sure we pull all results from the database.
+			if !ok {
+				continue
+			}
+			log.Printf("Query %d (%s) took %s\n", ii+1, modes[idx], elapsed)
 		}
-		if err := rows.Err(); err != nil {
-			return err
+	}
+}
+
+const userUIDsQuery = "SELECT users.uid as uid from users"
+
+// queryUserACL fetches every ACE of a random user.
+func queryUserACL(db *sql.DB) (bool, error) {
+	rows, err := queryDB(db, userUIDsQuery)
+	if err != nil {
+		return false, err
+	}
+	userids := []string{}
+	for rows.Next() {
+		var userid string
+		if err := rows.Scan(&userid); err != nil {
+			return false, err
 		}
-		now := time.Now()
-		elapsed := now.Sub(t)
-		t = now
-		log.Printf("Query %d took %s\n", ii+1, elapsed)
+		userids = append(userids, userid)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if len(userids) == 0 {
+		return false, nil
+	}
+	userid := userids[rand.Intn(len(userids))]
+	rows, err = queryDB(db, queries.UserACL, userid)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		// we ignore the actual data but iterate over the rows to make sure we pull all results from the database.
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
 	}
+	return true, nil
 }
 
 func main() {
@@ -67,12 +131,51 @@ func main() {
 	var tlsKeyFileF string
 	var tlsCertFileF string
 	var tlsCACertFileF string
+	var queriesF string
+	var explainF bool
+	var chaosNodesF string
+	var chaosStopF string
+	var chaosStartF string
+	var chaosAfterF time.Duration
+	var chaosDownF time.Duration
+	var chaosIntervalF time.Duration
+	var nodesFileF string
+	var nodesFilePollF time.Duration
+	var maxOpenConnsF int
+	var maxIdleConnsF int
+	var connMaxLifetimeF time.Duration
+	var poolStatsIntervalF time.Duration
+	var statementsF string
 	flag.StringVar(&addrF, "addr", "localhost:26257", "the address of the cockroachdb instance to connect to")
 	flag.StringVar(&tlsKeyFileF, "tls-key-file", "", "the path to the root user TLS key to use, if any")
 	flag.StringVar(&tlsCertFileF, "tls-cert-file", "", "the path to the root user TLS certificate to use, if any")
 	flag.StringVar(&tlsCACertFileF, "tls-ca-cert-file", "", "the path to the CA certificate to use, if any")
+	flag.StringVar(&queriesF, "queries", "acl", "comma-separated list of queries to run each iteration: acl (all ACEs of a user), check (single authorization check), principals (everyone with access to a resource), list (paginated listing of users, groups and resources)")
+	flag.Float64Var(&checkHitRatio, "check-hit-ratio", 0.5, "fraction of authorization checks that target a granted (user, resource, action) triple")
+	flag.IntVar(&pageSize, "page-size", 100, "number of rows per page for the list query")
+	flag.BoolVar(&explainF, "explain", false, "print the plans of the selected queries, report whether they perform an index join and exit")
+	flag.StringVar(&chaosNodesF, "chaos-nodes", "", "comma-separated list of nodes to stop and restart in turn while querying, substituted for {node} in -chaos-stop and -chaos-start")
+	flag.StringVar(&chaosStopF, "chaos-stop", "", "shell command that stops a node, e.g. 'docker kill roach{node}' (use with -chaos-nodes)")
+	flag.StringVar(&chaosStartF, "chaos-start", "", "shell command that starts a node, e.g. 'docker start roach{node}' (use with -chaos-nodes)")
+	flag.DurationVar(&chaosAfterF, "chaos-after", time.Minute, "how long after querying starts the first node is stopped (use with -chaos-nodes)")
+	flag.DurationVar(&chaosDownF, "chaos-down", 30*time.Second, "how long each node stays down (use with -chaos-nodes)")
+	flag.DurationVar(&chaosIntervalF, "chaos-interval", 0, "stop the next node this long after the previous one, 0 stops a single node (use with -chaos-nodes)")
+	flag.StringVar(&nodesFileF, "nodes-file", "", "instead of -addr, connect to the nodes listed in this file, one host:port per line or a JSON list, which is watched for changes")
+	flag.DurationVar(&nodesFilePollF, "nodes-file-poll", 10*time.Second, "how often to check -nodes-file for changes")
+	flag.IntVar(&maxOpenConnsF, "max-open-conns", 0, "maximum number of open connections to the database (0 is unlimited)")
+	flag.IntVar(&maxIdleConnsF, "max-idle-conns", 2, "maximum number of idle connections kept open")
+	flag.DurationVar(&connMaxLifetimeF, "conn-max-lifetime", 0, "close connections after they have been open this long (0 keeps them open)")
+	flag.DurationVar(&poolStatsIntervalF, "pool-stats-interval", 0, "report open and in-use connections and waits for a connection this often (0 disables the reports)")
+	flag.StringVar(&statementsF, "statements", "adhoc", "how to send the queries: adhoc (a string every time) or conn (prepared once per connection)")
 	flag.Parse()
 
+	switch statementsF {
+	case "adhoc", "conn":
+		statementMode = statementsF
+	default:
+		log.Fatalf("invalid -statements %q: must be one of adhoc, conn", statementsF)
+	}
+
 	log.Println("Connecting to cockroachdb server")
 	sslstr := "sslmode=disable"
 	if tlsKeyFileF != "" {
@@ -82,12 +185,58 @@ func main() {
 		sslargs = append(sslargs, "sslcert="+tlsCertFileF)
 		sslstr = strings.Join(sslargs, "&")
 	}
-	db, err := sql.Open("postgres", fmt.Sprintf("postgresql://root@%s/testdb?%s", addrF, sslstr))
-	if err != nil {
-		log.Fatal("error connecting to the database: ", err)
+	dsn := func(addr string) string { return fmt.Sprintf("postgresql://root@%s/testdb?%s", addr, sslstr) }
+	var db *sql.DB
+	if nodesFileF != "" {
+		nodes, err := discovery.Watch(nodesFileF, nodesFilePollF, log.Printf)
+		if err != nil {
+			log.Fatal("error reading the node list: ", err)
+		}
+		defer nodes.Close()
+		log.Printf("Connecting to the nodes listed in %s: %v", nodesFileF, nodes.List())
+		db = discovery.OpenDB(nodes, dsn)
+	} else {
+		var err error
+		db, err = sql.Open("postgres", dsn(addrF))
+		if err != nil {
+			log.Fatal("error connecting to the database: ", err)
+		}
+	}
+	poolConfig := pool.Config{MaxOpen: maxOpenConnsF, MaxIdle: maxIdleConnsF, MaxLifetime: connMaxLifetimeF}
+	poolConfig.Apply(db)
+	stopPoolStats := func() {}
+	if poolStatsIntervalF > 0 {
+		log.Printf("Reporting connection pool statistics every %s (%s)", poolStatsIntervalF, poolConfig)
+		stopPoolStats = pool.Report(db, poolStatsIntervalF, log.Printf)
+	}
+	if explainF {
+		if err := explainQueries(db, strings.Split(queriesF, ",")); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if chaosNodesF != "" {
+		m, err := chaos.Start(chaos.Config{
+			Nodes:    strings.Split(chaosNodesF, ","),
+			Stop:     chaosStopF,
+			Start:    chaosStartF,
+			After:    chaosAfterF,
+			Down:     chaosDownF,
+			Interval: chaosIntervalF,
+		}, log.Printf)
+		if err != nil {
+			log.Fatal("invalid chaos phase: ", err)
+		}
+		chaosMonkey = m
+	}
+	log.Printf("Querying database (statements=%s)", statementMode)
+	// An interrupt ends the queries like an error, so that a stopped node is restarted.
+	err := chaos.RunInterruptible(func() error { return performQueries(db, strings.Split(queriesF, ",")) })
+	if chaosMonkey != nil {
+		chaosMonkey.Stop()
 	}
-	log.Println("Querying database")
-	if err := performQueries(db); err != nil {
+	stopPoolStats()
+	if err != nil {
 		log.Fatal(err)
 	}
 
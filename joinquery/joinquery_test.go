@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/gpaul/cockroachload/dbtest"
+)
+
+func TestCheckQueryNext(t *testing.T) {
+	defer func(ratio float64) { checkHitRatio = ratio }(checkHitRatio)
+	granted := triple{"0", "user-resource-0", "read"}
+	c := &checkQuery{
+		uids:    []string{"0", "1"},
+		rids:    []string{"user-resource-0", "user-resource-1"},
+		granted: []triple{granted},
+		allowed: map[triple]bool{granted: true},
+	}
+	checkHitRatio = 1
+	for ii := 0; ii < 100; ii++ {
+		if got, ok := c.next(); !ok || got != granted {
+			t.Fatalf("next() with hit ratio 1 = %v, %t, want %v", got, ok, granted)
+		}
+	}
+	checkHitRatio = 0
+	for ii := 0; ii < 100; ii++ {
+		if got, ok := c.next(); !ok || c.allowed[got] {
+			t.Fatalf("next() with hit ratio 0 = %v, %t, want a triple that isn't granted", got, ok)
+		}
+	}
+	if _, ok := (&checkQuery{}).next(); ok {
+		t.Fatal("next() without loaded data returned a triple")
+	}
+}
+
+const testSchema = `
+CREATE TABLE users (id INTEGER PRIMARY KEY, uid STRING UNIQUE);
+CREATE TABLE groups (id INTEGER PRIMARY KEY, gid STRING UNIQUE);
+CREATE TABLE resources (id INTEGER PRIMARY KEY, rid STRING UNIQUE, description STRING);
+CREATE TABLE user_groups (user_id INTEGER, group_id INTEGER, PRIMARY KEY (user_id, group_id));
+CREATE TABLE aces (id INTEGER PRIMARY KEY, user_id INTEGER, group_id INTEGER, resource_id INTEGER, actions STRING);
+INSERT INTO users VALUES (1, '0'), (2, '1');
+INSERT INTO groups VALUES (1, '0');
+INSERT INTO resources VALUES (1, 'user-resource-0', 'some description'), (2, 'group-resource-0', 'some description');
+INSERT INTO user_groups VALUES (2, 1);
+INSERT INTO aces VALUES (1, 1, NULL, 1, 'create,read'), (2, NULL, 1, 2, 'read');
+`
+
+// newTestDB starts a single-node cluster and loads a small data set into it.
+// The test is skipped unless $COCKROACH_BINARY names a cockroach binary.
+func newTestDB(t *testing.T) *sql.DB {
+	db := dbtest.Cockroach(t)
+	if _, err := db.Exec("CREATE DATABASE testdb"); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range strings.Split(strings.TrimSpace(testSchema), "\n") {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestQueryModes(t *testing.T) {
+	db := newTestDB(t)
+	for mode, newQuery := range queryModes {
+		q, err := newQuery(db)
+		if err != nil {
+			t.Fatalf("preparing %s query: %v", mode, err)
+		}
+		if ok, err := q(db); err != nil || !ok {
+			t.Errorf("running %s query: ok=%t, err=%v", mode, ok, err)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	db := newTestDB(t)
+	for _, tc := range []struct {
+		t    triple
+		want bool
+	}{
+		{triple{"0", "user-resource-0", "read"}, true},
+		{triple{"0", "user-resource-0", "delete"}, false},
+		{triple{"1", "group-resource-0", "read"}, true},
+		{triple{"0", "group-resource-0", "read"}, false},
+	} {
+		got, err := checkAccess(db, tc.t.uid, tc.t.rid, tc.t.action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("checkAccess(%v) = %t, want %t", tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestExplainQueries(t *testing.T) {
+	db := newTestDB(t)
+	var modes []string
+	for mode := range explainedStatements {
+		modes = append(modes, mode)
+	}
+	if err := explainQueries(db, modes); err != nil {
+		t.Fatal(err)
+	}
+}
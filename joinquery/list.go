@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// pageSize is the number of rows per page of the list query.
+var pageSize = 100
+
+// listedTables are the tables walked by the list query and the column each one is paginated by.
+var listedTables = []struct{ table, column string }{
+	{"users", "uid"},
+	{"groups", "gid"},
+	{"resources", "rid"},
+}
+
+// queryList walks the users, groups and resources tables page by page, first using OFFSET and then keyset pagination.
+func queryList(db *sql.DB) (bool, error) {
+	if pageSize <= 0 {
+		return false, fmt.Errorf("page size must be positive, got %d", pageSize)
+	}
+	for _, lt := range listedTables {
+		offsetQuery, keysetQuery := listQueries(lt.table, lt.column)
+		if err := listPages(lt.table, "offset", func(page int, _ string) (*sql.Rows, error) {
+			return queryDB(db, offsetQuery, pageSize, page*pageSize)
+		}); err != nil {
+			return false, err
+		}
+		if err := listPages(lt.table, "keyset", func(_ int, last string) (*sql.Rows, error) {
+			return queryDB(db, keysetQuery, last, pageSize)
+		}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// listQueries returns the statements that page through table by column using OFFSET and keyset pagination.
+func listQueries(table, column string) (offset, keyset string) {
+	offset = fmt.Sprintf("SELECT %[2]s FROM %[1]s ORDER BY %[2]s LIMIT $1 OFFSET $2", table, column)
+	keyset = fmt.Sprintf("SELECT %[2]s FROM %[1]s WHERE %[2]s > $1 ORDER BY %[2]s LIMIT $2", table, column)
+	return offset, keyset
+}
+
+// listStatements returns the statements run by queryList.
+func listStatements() []string {
+	var stmts []string
+	for _, lt := range listedTables {
+		offset, keyset := listQueries(lt.table, lt.column)
+		stmts = append(stmts, offset, keyset)
+	}
+	return stmts
+}
+
+// listPages fetches pages until a short page is returned, logging the latency of each page.
+// fetch receives the page number and the last key of the previous page.
+func listPages(table, style string, fetch func(page int, last string) (*sql.Rows, error)) error {
+	last := ""
+	for page := 0; ; page++ {
+		t := time.Now()
+		rows, err := fetch(page, last)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for rows.Next() {
+			if err := rows.Scan(&last); err != nil {
+				rows.Close()
+				return err
+			}
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		log.Printf("List %s page %d (%s, %d rows) took %s\n", table, page+1, style, count, time.Since(t))
+		if count < pageSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"math/rand"
+
+	"github.com/gpaul/cockroachload/queries"
+)
+
+// newResourcePrincipalsQuery returns a query that lists every principal with access to a random resource,
+// expanding group grants to the members of the group.
+func newResourcePrincipalsQuery(db *sql.DB) (query, error) {
+	rids, err := queryStrings(db, "SELECT rid from resources")
+	if err != nil {
+		return nil, err
+	}
+	return func(db *sql.DB) (bool, error) {
+		if len(rids) == 0 {
+			return false, nil
+		}
+		rid := rids[rand.Intn(len(rids))]
+		rows, err := queryDB(db, queries.ResourcePrincipals, rid)
+		if err != nil {
+			return false, err
+		}
+		for rows.Next() {
+			// we ignore the actual data but iterate over the rows to make sure we pull all results from the database.
+		}
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}, nil
+}
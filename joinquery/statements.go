@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// statementMode determines how the queries are sent: adhoc sends the query string every time,
+// which lib/pq turns into an unnamed prepare followed by an execute, while conn prepares each
+// query once per connection and reuses it, as an ORM would.
+var statementMode = "adhoc"
+
+var (
+	preparedMu sync.Mutex
+	prepared   = map[*sql.DB]map[string]*sql.Stmt{}
+)
+
+// queryDB runs query on db according to statementMode.
+func queryDB(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	switch statementMode {
+	case "adhoc":
+		return db.Query(query, args...)
+	case "conn":
+		stmt, err := prepare(db, query)
+		if err != nil {
+			return nil, err
+		}
+		return stmt.Query(args...)
+	}
+	return nil, fmt.Errorf("invalid statement mode %q: must be one of adhoc, conn", statementMode)
+}
+
+// prepareStatements prepares the statements of the query modes in conn mode, so the timed queries don't include a prepare.
+// The queries run one at a time and so reuse the connection the statements were prepared on, unless it was closed.
+func prepareStatements(db *sql.DB, modes []string) error {
+	if statementMode != "conn" {
+		return nil
+	}
+	for _, mode := range modes {
+		for _, query := range queryStatements[mode]() {
+			if _, err := prepare(db, query); err != nil {
+				return fmt.Errorf("error preparing the statements of the %s query: %v", mode, err)
+			}
+		}
+	}
+	return nil
+}
+
+// prepare returns query prepared on db. database/sql prepares it on each connection the first time it is used there.
+func prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	preparedMu.Lock()
+	defer preparedMu.Unlock()
+	stmts, ok := prepared[db]
+	if !ok {
+		stmts = map[string]*sql.Stmt{}
+		prepared[db] = stmts
+	}
+	if stmt, ok := stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	stmts[query] = stmt
+	return stmt, nil
+}
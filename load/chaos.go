@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gpaul/cockroachload/chaos"
+)
+
+var (
+	// chaosMonkey is set while nodes are stopped and restarted during the workload.
+	chaosMonkey *chaos.Monkey
+	// chaosRetryTimeout bounds how long a transaction that fails because a node is down is retried during the chaos phase.
+	chaosRetryTimeout time.Duration
+)
+
+const chaosRetryBackoff = 100 * time.Millisecond
+
+func startChaos(cfg chaos.Config) error {
+	m, err := chaos.Start(cfg, say)
+	if err != nil {
+		return err
+	}
+	chaosMonkey = m
+	return nil
+}
+
+// stopChaos ends the chaos phase, if any, restarting a node that is still down.
+func stopChaos() {
+	if chaosMonkey == nil {
+		return
+	}
+	reports := chaosMonkey.Stop()
+	chaosMonkey = nil
+	say("Chaos phase stopped after %d events", len(reports))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A checkpoint records how far a sweep got, so that an interrupted run can be resumed with -resume.
+// It is rewritten after every completed iteration.
+type checkpoint struct {
+	// Iteration is the last completed iteration and Counts the record counts it loaded.
+	Iteration int         `json:"iteration"`
+	Counts    recordCount `json:"counts"`
+	// Sweep and Tags describe the run, which must be resumed with the same options.
+	Sweep string `json:"sweep"`
+	Tags  string `json:"tags"`
+	// Results is the results file, if any, and ResultsSize its length after Iteration's result was written.
+	Results     string    `json:"results,omitempty"`
+	ResultsSize int64     `json:"results_size,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// An iterationResult is a line of the results file.
+type iterationResult struct {
+	Iteration int         `json:"iteration"`
+	Counts    recordCount `json:"counts"`
+	Tags      string      `json:"tags"`
+	// Skipped is true if the record counts make no sense, so nothing was loaded.
+	Skipped bool      `json:"skipped,omitempty"`
+	Start   time.Time `json:"start"`
+	// Seconds excludes PrepareSeconds, the time spent preparing statements on first use.
+	Seconds        float64 `json:"seconds"`
+	PrepareSeconds float64 `json:"prepare_seconds,omitempty"`
+}
+
+func (counts recordCount) MarshalJSON() ([]byte, error) {
+	m := map[string]int{}
+	for rt, n := range counts {
+		m[recordTypeNames[rt]] = n
+	}
+	return json.Marshal(m)
+}
+
+func (counts *recordCount) UnmarshalJSON(data []byte) error {
+	var m map[string]int
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for name, n := range m {
+		rt := RecordType(0)
+		for rt < LastRecordType && recordTypeNames[rt] != name {
+			rt++
+		}
+		if rt == LastRecordType {
+			return fmt.Errorf("invalid record type %q", name)
+		}
+		counts[rt] = n
+	}
+	return nil
+}
+
+// sweepProgress writes the result of every completed iteration of a sweep to the results file and updates the checkpoint.
+// Either path may be empty to skip writing it.
+type sweepProgress struct {
+	checkpointPath string
+	resultsPath    string
+	sweep, tags    string
+	results        *os.File
+	// next is the first iteration to run.
+	next int
+}
+
+// openSweepProgress starts recording the progress of s.
+// If resume is set and the checkpoint exists, the sweep continues after the checkpoint's iteration
+// and the results file is truncated to the results written up to it.
+// Otherwise the results file is overwritten.
+func openSweepProgress(checkpointPath, resultsPath string, s sweep, resume bool) (*sweepProgress, error) {
+	p := &sweepProgress{checkpointPath: checkpointPath, resultsPath: resultsPath, sweep: s.String(), tags: runTags()}
+	var cp *checkpoint
+	if resume {
+		data, err := ioutil.ReadFile(checkpointPath)
+		switch {
+		case os.IsNotExist(err):
+			say("No checkpoint in %s, starting the sweep from the beginning", checkpointPath)
+		case err != nil:
+			return nil, err
+		default:
+			cp = &checkpoint{}
+			if err := json.Unmarshal(data, cp); err != nil {
+				return nil, fmt.Errorf("invalid checkpoint %s: %v", checkpointPath, err)
+			}
+		}
+	}
+	if cp == nil {
+		if resultsPath != "" {
+			f, err := os.Create(resultsPath)
+			if err != nil {
+				return nil, err
+			}
+			p.results = f
+		}
+		return p, nil
+	}
+
+	if cp.Sweep != p.sweep {
+		return nil, fmt.Errorf("checkpoint %s is for a different sweep (%s), not %s", checkpointPath, cp.Sweep, p.sweep)
+	}
+	if cp.Tags != p.tags {
+		return nil, fmt.Errorf("checkpoint %s is for a run with different options (%s), not %s", checkpointPath, cp.Tags, p.tags)
+	}
+	if resultsPath == "" {
+		p.resultsPath = cp.Results
+	} else if resultsPath != cp.Results {
+		return nil, fmt.Errorf("checkpoint %s has its results in %q, not %q", checkpointPath, cp.Results, resultsPath)
+	}
+	if p.resultsPath != "" {
+		f, err := os.OpenFile(p.resultsPath, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err == nil && info.Size() < cp.ResultsSize {
+			err = fmt.Errorf("%s is shorter (%d bytes) than when the checkpoint was written (%d bytes)", p.resultsPath, info.Size(), cp.ResultsSize)
+		}
+		if err == nil {
+			// Drop the result of an iteration that completed after the checkpoint was written, if any.
+			err = f.Truncate(cp.ResultsSize)
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.results = f
+	}
+	p.next = cp.Iteration + 1
+	say("Resuming the sweep at iteration %d, after %s completed at %s", p.next, cp.Counts, cp.Time.Format(time.RFC3339))
+	return p, nil
+}
+
+// completed records that iteration, which loaded counts, started at start and took elapsed, plus preparing spent preparing statements.
+func (p *sweepProgress) completed(iteration int, counts recordCount, start time.Time, elapsed, preparing time.Duration) error {
+	cp := checkpoint{Iteration: iteration, Counts: counts, Sweep: p.sweep, Tags: p.tags, Results: p.resultsPath, Time: time.Now()}
+	if p.results != nil {
+		line, err := json.Marshal(iterationResult{
+			Iteration:      iteration,
+			Counts:         counts,
+			Tags:           p.tags,
+			Skipped:        !counts.sane(),
+			Start:          start,
+			Seconds:        elapsed.Seconds(),
+			PrepareSeconds: preparing.Seconds(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := p.results.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if cp.ResultsSize, err = p.results.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	if p.checkpointPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write the checkpoint next to the old one and rename it, so that a crash never leaves a partial checkpoint behind.
+	tmp := p.checkpointPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.checkpointPath)
+}
+
+func (p *sweepProgress) close() error {
+	if p.results == nil {
+		return nil
+	}
+	return p.results.Close()
+}
+
+// ensureEmpty checks that the interrupted iteration left no data behind and removes it otherwise.
+func ensureEmpty(db *sql.DB) error {
+	err := checkEmpty(db)
+	if err == nil {
+		return nil
+	}
+	say("Removing data left by the interrupted iteration: %v", err)
+	if err := removeData(db); err != nil {
+		return err
+	}
+	return checkEmpty(db)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+var (
+	churnDuration time.Duration
+	churnRate     int
+)
+
+// churnMemberships moves random users from one of their groups to another group for churnDuration,
+// performing at most churnRate moves per second. It keeps the number of user_groups rows constant
+// so that it can run against a loaded data set while a read workload (e.g. joinquery) is running.
+func churnMemberships(db *sql.DB, users, groups int) error {
+	if churnRate <= 0 {
+		return fmt.Errorf("churn rate must be positive, got %d", churnRate)
+	}
+	if churnRate > int(time.Second) {
+		// The ticker's interval would be 0, which time.NewTicker rejects with a panic.
+		return fmt.Errorf("churn rate can't exceed one move per nanosecond, got %d", churnRate)
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(churnRate))
+	defer ticker.Stop()
+	deadline := time.After(churnDuration)
+	var moved, skipped int
+	for {
+		select {
+		case <-deadline:
+			say("Churned %d memberships (%d skipped)", moved, skipped)
+			return nil
+		case <-ticker.C:
+		}
+		user, group := rand.Intn(users), rand.Intn(groups)
+		var move *membershipMove
+		if err := logTimingV(fmt.Sprintf("Move user %d to group %d", user, group), func() error {
+			var err error
+			move, err = moveUserToGroup(db, user, group)
+			return err
+		}); err != nil {
+			return err
+		}
+		if move != nil {
+			moved++
+		} else {
+			skipped++
+		}
+	}
+}
+
+// A membershipMove records that the user with ID userId was moved from the group with ID from to the one with ID to.
+type membershipMove struct {
+	userId, from, to int64
+}
+
+// moveUserToGroup removes the user from one of the groups it is a member of and adds it to the given group.
+// It returns nil without modifying anything if the user is not a member of any group or is already
+// a member of the given group.
+func moveUserToGroup(db *sql.DB, user, group int) (move *membershipMove, err error) {
+	err = executeTx(db, func(tx *txn) error {
+		move = nil
+		var userId int64
+		row := tx.QueryRow(fmt.Sprintf("SELECT id from users where users.uid %s $1", lookupOp()), strconv.Itoa(user))
+		if err := row.Scan(&userId); err != nil {
+			return err
+		}
+		var groupId int64
+		row = tx.QueryRow(fmt.Sprintf("SELECT id from groups where groups.gid %s $1", lookupOp()), strconv.Itoa(group))
+		if err := row.Scan(&groupId); err != nil {
+			return err
+		}
+		var oldGroupId int64
+		row = tx.QueryRow("SELECT group_id from user_groups where user_id = $1 and group_id != $2 LIMIT 1", userId, groupId)
+		if err := row.Scan(&oldGroupId); err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var member int
+		row = tx.QueryRow("SELECT count(*) from user_groups where user_id = $1 and group_id = $2", userId, groupId)
+		if err := row.Scan(&member); err != nil {
+			return err
+		}
+		if member > 0 {
+			return nil
+		}
+		if _, err := tx.Exec("DELETE FROM user_groups where user_id = $1 and group_id = $2", userId, oldGroupId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO user_groups (user_id, group_id) VALUES ($1, $2)", userId, groupId); err != nil {
+			return err
+		}
+		move = &membershipMove{userId: userId, from: oldGroupId, to: groupId}
+		return nil
+	})
+	return move, err
+}
+
+// undoMove moves the user back to the group it was moved from.
+func undoMove(db *sql.DB, move membershipMove) error {
+	return executeTx(db, func(tx *txn) error {
+		if _, err := tx.Exec("DELETE FROM user_groups where user_id = $1 and group_id = $2", move.userId, move.to); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO user_groups (user_id, group_id) VALUES ($1, $2)", move.userId, move.from)
+		return err
+	})
+}
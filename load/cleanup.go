@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// cleanupStrategy determines how removeData removes the loaded data:
+//
+//	per-record: every user, group and resource is looked up and deleted in its own transaction, as a non-bulk interface would
+//	batched: every table is emptied with DELETE ... LIMIT cleanupBatchSize until nothing is left
+//	truncate: all tables are emptied with a single TRUNCATE
+//	recreate: the database is dropped and the schema created again
+var cleanupStrategy = "per-record"
+
+var cleanupStrategies = []string{"per-record", "batched", "truncate", "recreate"}
+
+var cleanupBatchSize = 1000
+
+// cleanupTables are the tables removeData empties, referencing tables first so that no foreign key is violated.
+var cleanupTables = []string{"aces", "user_groups", "users", "groups", "resources"}
+
+func selectCleanupStrategy(strategy string) error {
+	for _, s := range cleanupStrategies {
+		if s == strategy {
+			cleanupStrategy = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid cleanup strategy %q: must be one of %v", strategy, cleanupStrategies)
+}
+
+// removeData removes the loaded data using cleanupStrategy and logs how long it took.
+func removeData(db *sql.DB) error {
+	return logTiming(fmt.Sprintf("Removing data (cleanup=%s)", cleanupStrategy), func() error {
+		switch cleanupStrategy {
+		case "batched":
+			return deleteBatches(db, cleanupBatchSize)
+		case "truncate":
+			return truncateTables(db)
+		case "recreate":
+			return executeTx(db, createSchema)
+		}
+		return removeRecords(db)
+	})
+}
+
+// deleteBatches empties every table batchSize rows at a time.
+func deleteBatches(db *sql.DB, batchSize int) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("the cleanup batch size must be positive, got %d", batchSize)
+	}
+	for _, table := range cleanupTables {
+		deleted := int64(0)
+		if err := logTimingV("Delete from "+table, func() error {
+			for {
+				result, err := execSingleResult(db, fmt.Sprintf("DELETE FROM %s LIMIT %d", table, batchSize))
+				if err != nil {
+					return err
+				}
+				n, err := result.RowsAffected()
+				if err != nil {
+					return err
+				}
+				deleted += n
+				if n < int64(batchSize) {
+					return nil
+				}
+			}
+		}); err != nil {
+			return err
+		}
+		if verbose {
+			say("Deleted %d rows from %s", deleted, table)
+		}
+	}
+	return nil
+}
+
+// truncateTables empties all tables with a single statement, so that foreign keys between them don't get in the way.
+func truncateTables(db *sql.DB) error {
+	return execSingle(db, "TRUNCATE TABLE "+strings.Join(cleanupTables, ", "))
+}
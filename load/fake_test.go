@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/chaos"
+	"github.com/gpaul/cockroachload/clock"
+	"github.com/gpaul/cockroachload/dbtest"
+	"github.com/gpaul/cockroachload/pgfake"
+	"github.com/lib/pq"
+)
+
+// recordingScript is a pgfake.Script that also records the arguments of every statement.
+type recordingScript struct {
+	*pgfake.Script
+	mu   sync.Mutex
+	args map[string][][]*string
+}
+
+func (s *recordingScript) Execute(query string, args []*string) (*pgfake.Result, error) {
+	s.mu.Lock()
+	s.args[query] = append(s.args[query], args)
+	s.mu.Unlock()
+	return s.Script.Execute(query, args)
+}
+
+// newFakeDB serves rules from a pgfake server and connects to it. Both are closed when the test finishes.
+func newFakeDB(t *testing.T, rules ...pgfake.Rule) (*sql.DB, *pgfake.Server, *recordingScript) {
+	script := &recordingScript{Script: pgfake.NewScript(rules...), args: map[string][][]*string{}}
+	db, server := dbtest.Fake(t, script)
+	return db, server, script
+}
+
+func row(values ...interface{}) [][]interface{} { return [][]interface{}{values} }
+
+func TestAddUserRetriesOnRetryableError(t *testing.T) {
+	db, _, script := newFakeDB(t,
+		pgfake.Rule{Pattern: `^INSERT INTO users`, Err: &pgfake.Error{Code: "40001", Message: "restart transaction"}, Times: 1},
+		pgfake.Rule{Pattern: `^INSERT INTO users`},
+	)
+	if err := addUser(db, 3); err != nil {
+		t.Fatal(err)
+	}
+	inserts := script.args["INSERT INTO users (uid, passwordhash, utype, description, is_remote) VALUES ($1, $2, $3, $4, $5) RETURNING users.id"]
+	if len(inserts) != 2 {
+		t.Fatalf("user was inserted %d times, want 2", len(inserts))
+	}
+	if uid := *inserts[1][0]; uid != "3" {
+		t.Errorf("inserted uid %q, want 3", uid)
+	}
+}
+
+func TestAddUserToGroupMissingUser(t *testing.T) {
+	db, _, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT id from users`, Result: pgfake.Result{Columns: []string{"id"}}},
+	)
+	if err := addUserToGroup(db, 0, 0); err != sql.ErrNoRows {
+		t.Fatalf("addUserToGroup() for a missing user = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestGrantUserActionAppendsToExistingACE(t *testing.T) {
+	db, _, script := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT resources.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(10)}},
+		pgfake.Rule{Pattern: `^SELECT users.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(20)}},
+		pgfake.Rule{Pattern: `^SELECT aces.actions`, Result: pgfake.Result{Columns: []string{"actions", "id"}, Rows: row("create", 30)}},
+		pgfake.Rule{Pattern: `^UPDATE aces`},
+	)
+	if err := grantUserAction(db, "user-resource-0", 0, "read"); err != nil {
+		t.Fatal(err)
+	}
+	updates := script.args["UPDATE aces SET actions = $1 WHERE aces.id=$2"]
+	if len(updates) != 1 || *updates[0][0] != "create,read" || *updates[0][1] != "30" {
+		t.Fatalf("unexpected ACE updates %v", updates)
+	}
+}
+
+func TestGrantGroupActionCreatesACE(t *testing.T) {
+	db, _, script := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT resources.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(10)}},
+		pgfake.Rule{Pattern: `^SELECT groups.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(20)}},
+		pgfake.Rule{Pattern: `^SELECT aces.actions`, Result: pgfake.Result{Columns: []string{"actions", "id"}}},
+		pgfake.Rule{Pattern: `^INSERT INTO aces`},
+	)
+	if err := grantGroupAction(db, "group-resource-0", 0, "read"); err != nil {
+		t.Fatal(err)
+	}
+	inserts := script.args["INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES ($1, $2, $3, $4)"]
+	if len(inserts) != 1 || inserts[0][0] != nil || *inserts[0][1] != "20" || *inserts[0][3] != "read" {
+		t.Fatalf("unexpected ACE inserts %v", inserts)
+	}
+}
+
+func TestRemoveUserWithCascade(t *testing.T) {
+	defer selectSchema("default")
+	if err := selectSchema("fk"); err != nil {
+		t.Fatal(err)
+	}
+	db, server, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^DELETE FROM users where uid LIKE \$1$`},
+	)
+	if err := removeUser(db, "0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range server.Queries() {
+		if strings.HasPrefix(q, "DELETE") && q != "DELETE FROM users where uid LIKE $1" {
+			t.Errorf("unexpected statement %q", q)
+		}
+	}
+}
+
+func TestLookupStyleEq(t *testing.T) {
+	defer func(style string) { lookupStyle = style }(lookupStyle)
+	lookupStyle = "eq"
+	db, _, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT id from resources where rid = \$1$`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(1)}},
+		pgfake.Rule{Pattern: `^DELETE FROM`},
+	)
+	if err := removeResource(db, "user-resource-0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyDatasetReportsMismatches(t *testing.T) {
+	db, _, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT count\(\*\) FROM users$`, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(2)}},
+		pgfake.Rule{Pattern: `^SELECT count\(\*\) FROM `, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(0)}},
+		pgfake.Rule{Pattern: `^SELECT id, actions FROM aces$`, Result: pgfake.Result{Columns: []string{"id", "actions"}, Rows: row(1, "read,read")}},
+	)
+	if err := verifyDataset(db, recordCount{Users: 2}); err == nil {
+		t.Fatal("verifying a data set with a duplicate action succeeded")
+	}
+}
+
+func TestCheckEmptyReportsLeftoverTables(t *testing.T) {
+	db, _, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SELECT count\(\*\) FROM aces$`, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(3)}},
+		pgfake.Rule{Pattern: `^SELECT count\(\*\) FROM `, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(0)}},
+	)
+	err := checkEmpty(db)
+	if err == nil || !strings.Contains(err.Error(), "aces: 3") {
+		t.Fatalf("checkEmpty() = %v, want leftover aces", err)
+	}
+}
+
+// rowCounts is a pgfake.Handler that keeps the number of rows in each table, answering counts and emptying tables on TRUNCATE.
+type rowCounts struct {
+	mu     sync.Mutex
+	tables map[string]int
+}
+
+func (c *rowCounts) Describe(query string) ([]string, error) { return nil, nil }
+
+func (c *rowCounts) Execute(query string, args []*string) (*pgfake.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case strings.HasPrefix(query, "SELECT count(*) FROM "):
+		table := strings.TrimPrefix(query, "SELECT count(*) FROM ")
+		return &pgfake.Result{Columns: []string{"count"}, Rows: row(c.tables[table])}, nil
+	case strings.HasPrefix(query, "TRUNCATE TABLE "):
+		for _, table := range strings.Split(strings.TrimPrefix(query, "TRUNCATE TABLE "), ", ") {
+			delete(c.tables, table)
+		}
+		return &pgfake.Result{}, nil
+	case isTxControl(query):
+		return &pgfake.Result{}, nil
+	}
+	return nil, &pgfake.Error{Code: "42601", Message: "unexpected statement"}
+}
+
+func TestEnsureEmptyRemovesLeftovers(t *testing.T) {
+	defer func(strategy string) { cleanupStrategy = strategy }(cleanupStrategy)
+	cleanupStrategy = "truncate"
+	counts := &rowCounts{tables: map[string]int{"users": 5, "aces": 2}}
+	db, server := dbtest.Fake(t, counts)
+	if err := ensureEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts.tables) != 0 {
+		t.Errorf("rows left over: %v", counts.tables)
+	}
+	// Once the tables are empty, there is nothing to remove.
+	if err := ensureEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+	var truncates int
+	for _, q := range server.Queries() {
+		if strings.HasPrefix(q, "TRUNCATE") {
+			truncates++
+		}
+	}
+	if truncates != 1 {
+		t.Errorf("emptied the tables %d times, want once", truncates)
+	}
+}
+
+func TestRunWithCountsWaitsForSchemaChangeOnError(t *testing.T) {
+	defer func(ddl, strategy string) { schemaChangeDDL, cleanupStrategy = ddl, strategy }(schemaChangeDDL, cleanupStrategy)
+	schemaChangeDDL, cleanupStrategy = "CREATE INDEX users_description_idx ON users (description)", "truncate"
+	db, server, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^INSERT INTO users`, Err: &pgfake.Error{Code: "23514", Message: "check constraint violated"}},
+		pgfake.Rule{Pattern: `^CREATE INDEX`},
+		pgfake.Rule{Pattern: `^TRUNCATE TABLE`},
+		pgfake.Rule{Pattern: `^SELECT count`, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(0)}},
+	)
+	if err := runWithCounts(db, recordCount{Users: 1}); err == nil {
+		t.Fatal("runWithCounts() succeeded although adding a user failed")
+	}
+	recorderMu.Lock()
+	leaked := len(activeRecorders)
+	recorderMu.Unlock()
+	if leaked != 0 {
+		t.Errorf("%d recorders are still active", leaked)
+	}
+	var ddl int
+	for _, q := range server.Queries() {
+		if q == schemaChangeDDL {
+			ddl++
+		}
+	}
+	if ddl != 1 {
+		t.Errorf("the schema change ran %d times before runWithCounts returned, want 1", ddl)
+	}
+}
+
+func TestAddUserRetriesAcrossConnectionReset(t *testing.T) {
+	_, server, _ := newFakeDB(t, pgfake.Rule{Pattern: `^INSERT INTO users`})
+	manual := clock.NewManual(time.Unix(0, 0))
+	p, err := startFaultProxyWithClock(server.Addr(), faultConfig{reset: true}, faultSchedule{after: time.Second, duration: time.Hour}, manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	db, err := sql.Open("postgres", strings.Replace(server.URL(), server.Addr(), p.addr(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := addUser(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Open the window, which resets the pooled connection. Once it is open, the schedule waits for it to close.
+	manual.WaitForTimers(1)
+	manual.Advance(time.Second)
+	manual.WaitForTimers(1)
+	if err := addUser(db, 1); err != nil {
+		t.Fatalf("addUser() after the connection was reset: %v", err)
+	}
+}
+
+func TestExecuteTxRetriesDuringChaos(t *testing.T) {
+	db, _, script := newFakeDB(t,
+		pgfake.Rule{Pattern: `^INSERT INTO users`, Err: &pgfake.Error{Code: "57P01", Message: "server is shutting down"}, Times: 2},
+		pgfake.Rule{Pattern: `^INSERT INTO users`},
+	)
+	if err := addUser(db, 0); err == nil {
+		t.Fatal("addUser() succeeded outside the chaos phase")
+	}
+
+	defer func(timeout time.Duration) { chaosRetryTimeout = timeout }(chaosRetryTimeout)
+	chaosRetryTimeout = time.Minute
+	if err := startChaos(chaos.Config{Nodes: []string{"1"}, Stop: "true", Start: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	defer stopChaos()
+	r := startRecording()
+	defer r.stop()
+	if err := addUser(db, 1); err != nil {
+		t.Fatalf("addUser() during the chaos phase: %v", err)
+	}
+	samples := r.samplesBetween(time.Time{}, time.Now())
+	if len(samples) != 2 || samples[0].err == nil || samples[1].err != nil {
+		t.Errorf("unexpected samples %+v", samples)
+	}
+	if inserts := script.args["INSERT INTO users (uid, passwordhash, utype, description, is_remote) VALUES ($1, $2, $3, $4, $5) RETURNING users.id"]; len(inserts) != 3 {
+		t.Errorf("user was inserted %d times, want 3", len(inserts))
+	}
+}
+
+func TestStatementModes(t *testing.T) {
+	defer func(mode string) { statementMode = mode }(statementMode)
+	const update = "UPDATE aces SET actions = $1 WHERE aces.id=$2"
+	// Three grants run and the first one's update is retried within its transaction, so the update runs four times
+	// in three transactions. In conn mode, it is prepared on a connection of its own and again on the connection of the
+	// first transaction, after which every connection in the pool has it.
+	for mode, prepares := range map[string]int{"adhoc": 4, "tx": 3, "conn": 2} {
+		t.Run(mode, func(t *testing.T) {
+			if err := selectStatementMode(mode); err != nil {
+				t.Fatal(err)
+			}
+			db, server, _ := newFakeDB(t,
+				pgfake.Rule{Pattern: `^SELECT resources.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(10)}},
+				pgfake.Rule{Pattern: `^SELECT users.id`, Result: pgfake.Result{Columns: []string{"id"}, Rows: row(20)}},
+				pgfake.Rule{Pattern: `^SELECT aces.actions`, Result: pgfake.Result{Columns: []string{"actions", "id"}, Rows: row("create", 30)}},
+				pgfake.Rule{Pattern: `^UPDATE aces`, Err: &pgfake.Error{Code: "40001", Message: "restart transaction"}, Times: 1},
+				pgfake.Rule{Pattern: `^UPDATE aces`},
+			)
+			for ii := 0; ii < 3; ii++ {
+				if err := grantUserAction(db, "user-resource-0", 0, "read"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := server.Prepared()[update]; got != prepares {
+				t.Errorf("the update was prepared %d times, want %d", got, prepares)
+			}
+		})
+	}
+	if err := selectStatementMode("batch"); err == nil {
+		t.Error("invalid statement mode accepted")
+	}
+}
+
+func TestImplicitTxnRetriesWithoutTransaction(t *testing.T) {
+	defer func(implicit bool, mode string) { implicitTxns, statementMode = implicit, mode }(implicitTxns, statementMode)
+	implicitTxns = true
+	const insert = "INSERT INTO groups (gid, description) VALUES ($1, $2) RETURNING groups.id"
+	for _, mode := range statementModes {
+		t.Run(mode, func(t *testing.T) {
+			statementMode = mode
+			db, server, _ := newFakeDB(t,
+				pgfake.Rule{Pattern: `^INSERT INTO groups`, Err: &pgfake.Error{Code: "40001", Message: "restart transaction"}, Times: 1},
+				pgfake.Rule{Pattern: `^INSERT INTO groups`},
+			)
+			r := startRecording()
+			defer r.stop()
+			if err := addGroup(db, 7); err != nil {
+				t.Fatal(err)
+			}
+			// The retry resends the statement on its own, without BEGIN, SAVEPOINT or COMMIT around it.
+			if got := server.Queries(); fmt.Sprint(got) != fmt.Sprint([]string{insert, insert}) {
+				t.Errorf("sent %q, want the insert twice", got)
+			}
+			if samples := r.samplesBetween(time.Time{}, time.Now()); len(samples) != 1 || samples[0].retries != 1 || samples[0].err != nil {
+				t.Errorf("recorded %+v, want one successful operation with one retry", samples)
+			}
+		})
+	}
+}
+
+func TestImplicitTxnGivesUpAfterMaxAttempts(t *testing.T) {
+	defer func(implicit bool, min, max time.Duration) {
+		implicitTxns, implicitTxnMinBackoff, implicitTxnMaxBackoff = implicit, min, max
+	}(implicitTxns, implicitTxnMinBackoff, implicitTxnMaxBackoff)
+	implicitTxns, implicitTxnMinBackoff, implicitTxnMaxBackoff = true, time.Microsecond, time.Millisecond
+	db, server, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^INSERT INTO resources`, Err: &pgfake.Error{Code: "40001", Message: "restart transaction"}},
+	)
+	err := addResource(db, "contended")
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "40001" {
+		t.Fatalf("addResource() under endless contention = %v, want the retryable error", err)
+	}
+	if attempts := len(server.Queries()); attempts != implicitTxnMaxAttempts {
+		t.Errorf("sent the insert %d times, want %d", attempts, implicitTxnMaxAttempts)
+	}
+}
+
+func TestUpsertGrants(t *testing.T) {
+	defer func(style string) { grantStyle = style }(grantStyle)
+	grantStyle = "upsert"
+	db, server, script := newFakeDB(t,
+		pgfake.Rule{Pattern: `(?s)^INSERT INTO aces .* FROM users, resources.*ON CONFLICT \(user_id, resource_id\)`},
+		pgfake.Rule{Pattern: `(?s)^INSERT INTO aces .* FROM groups, resources.*ON CONFLICT \(group_id, resource_id\)`, Result: pgfake.Result{Tag: "INSERT 0 0"}},
+	)
+	if err := allowUserAccessToResource(db, "user-resource-0", 3); err != nil {
+		t.Fatal(err)
+	}
+	// All actions are granted by one statement, which looks up the user and resource itself.
+	upsert := fmt.Sprintf(upsertUserGrantQuery, lookupOp())
+	var statements []string
+	for _, q := range server.Queries() {
+		if !isTxControl(q) {
+			statements = append(statements, q)
+		}
+	}
+	if len(statements) != 1 || statements[0] != upsert {
+		t.Errorf("granting all actions took statements %q, want a single upsert", statements)
+	}
+	if args := script.args[upsert]; len(args) != 1 || *args[0][2] != "create,read,update,delete" {
+		t.Errorf("upserted %v, want all actions at once", args)
+	}
+	// An upsert that inserts nothing means the group or resource doesn't exist.
+	if err := grantGroupAction(db, "group-resource-0", 0, "read"); err != sql.ErrNoRows {
+		t.Errorf("granting to a missing group returned %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestCleanupStrategies(t *testing.T) {
+	defer func(strategy string, size int) { cleanupStrategy, cleanupBatchSize = strategy, size }(cleanupStrategy, cleanupBatchSize)
+	cleanupBatchSize = 2
+	for _, tc := range []struct {
+		strategy string
+		rules    []pgfake.Rule
+		want     []string
+	}{
+		{
+			// Tables are deleted from until a batch comes up short, children first.
+			strategy: "batched",
+			rules: []pgfake.Rule{
+				{Pattern: `^DELETE FROM aces LIMIT 2$`, Result: pgfake.Result{Tag: "DELETE 2"}, Times: 1},
+				{Pattern: `^DELETE FROM aces LIMIT 2$`, Result: pgfake.Result{Tag: "DELETE 1"}, Times: 1},
+				{Pattern: `^DELETE FROM \w+ LIMIT 2$`, Result: pgfake.Result{Tag: "DELETE 0"}},
+			},
+			want: []string{"DELETE FROM aces LIMIT 2", "DELETE FROM aces LIMIT 2", "DELETE FROM user_groups LIMIT 2", "DELETE FROM users LIMIT 2", "DELETE FROM groups LIMIT 2", "DELETE FROM resources LIMIT 2"},
+		},
+		{
+			strategy: "truncate",
+			rules:    []pgfake.Rule{{Pattern: `^TRUNCATE TABLE`}},
+			want:     []string{"TRUNCATE TABLE aces, user_groups, users, groups, resources"},
+		},
+		{
+			strategy: "recreate",
+			rules:    []pgfake.Rule{{Pattern: `^\s*DROP DATABASE IF EXISTS testdb`}},
+			want:     []string{activeSchema.ddl},
+		},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			if err := selectCleanupStrategy(tc.strategy); err != nil {
+				t.Fatal(err)
+			}
+			db, server := dbtest.Fake(t, pgfake.NewScript(tc.rules...))
+			if err := removeData(db); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, q := range server.Queries() {
+				if !isTxControl(q) {
+					got = append(got, q)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("ran %q, want %q", got, tc.want)
+			}
+		})
+	}
+	if err := selectCleanupStrategy("vacuum"); err == nil {
+		t.Error("invalid cleanup strategy accepted")
+	}
+}
+
+func isTxControl(query string) bool {
+	for _, prefix := range []string{"BEGIN", "SAVEPOINT", "RELEASE", "COMMIT", "ROLLBACK"} {
+		if strings.HasPrefix(query, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEstimateIndexSize(t *testing.T) {
+	// CockroachDB 1.0 column names, for an aces table keyed by (owner_id, id).
+	db, _, _ := newFakeDB(t,
+		pgfake.Rule{Pattern: `^SHOW INDEX FROM aces$`, Result: pgfake.Result{
+			Columns: []string{"Table", "Name", "Unique", "Seq", "Column", "Direction", "Storing"},
+			Rows: [][]interface{}{
+				{"aces", "primary", true, 1, "owner_id", "ASC", false},
+				{"aces", "primary", true, 2, "id", "ASC", false},
+				{"aces", "aces_id_key", true, 1, "id", "ASC", false},
+			}}},
+		pgfake.Rule{Pattern: `^SELECT count\(\*\) FROM aces$`, Result: pgfake.Result{Columns: []string{"count"}, Rows: row(10)}},
+		pgfake.Rule{Pattern: `^SHOW COLUMNS FROM aces$`, Result: pgfake.Result{
+			Columns: []string{"Field", "Type", "Null", "Default"},
+			Rows: [][]interface{}{
+				{"id", "INT", false, "unique_rowid()"},
+				{"owner_id", "INT", false, nil},
+				{"resource_id", "INT", false, nil},
+				{"actions", "STRING", true, nil},
+			}}},
+		pgfake.Rule{Pattern: `^SELECT avg\(length\(actions\)\) FROM aces$`, Result: pgfake.Result{Columns: []string{"avg"}, Rows: row("11.6")}},
+	)
+	index, err := parseIndexCandidate("aces (resource_id) STORING (actions)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := estimateIndexSize(db, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// owner_id, id and resource_id take 8 bytes each and actions 12 on average.
+	if size != 10*36 {
+		t.Errorf("estimateIndexSize() = %d, want %d", size, 10*36)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gpaul/cockroachload/clock"
+)
+
+// faultConfig describes the faults a faultProxy injects while a fault window is open.
+type faultConfig struct {
+	latency   time.Duration // added to every chunk of data forwarded in either direction
+	jitter    time.Duration // a random extra delay of up to jitter per chunk
+	bandwidth int           // bytes per second in each direction, 0 for unlimited
+	reset     bool          // reset all open connections when a window opens
+	partition bool          // stall all traffic until the window closes
+}
+
+func (f faultConfig) enabled() bool {
+	return f.latency > 0 || f.jitter > 0 || f.bandwidth > 0 || f.reset || f.partition
+}
+
+func (f faultConfig) String() string {
+	var parts []string
+	if f.latency > 0 {
+		parts = append(parts, fmt.Sprintf("latency=%s", f.latency))
+	}
+	if f.jitter > 0 {
+		parts = append(parts, fmt.Sprintf("jitter=%s", f.jitter))
+	}
+	if f.bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("bandwidth=%dB/s", f.bandwidth))
+	}
+	if f.reset {
+		parts = append(parts, "reset")
+	}
+	if f.partition {
+		parts = append(parts, "partition")
+	}
+	if len(parts) == 0 {
+		return "no faults"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// faultSchedule determines when fault windows open and close.
+// The first window opens after `after`. A duration of 0 keeps it open for good,
+// otherwise a new window opens every interval, or never again if interval is 0.
+type faultSchedule struct {
+	after, duration, interval time.Duration
+}
+
+// window returns the offsets from the start of the schedule at which window i opens and closes.
+// ok is false if there is no such window.
+func (s faultSchedule) window(i int) (open, close time.Duration, ok bool) {
+	if i > 0 && (s.duration == 0 || s.interval == 0) {
+		return 0, 0, false
+	}
+	open = s.after + time.Duration(i)*s.interval
+	if s.duration == 0 {
+		return open, 0, true
+	}
+	return open, open + s.duration, true
+}
+
+// faultProxy is a TCP proxy in front of a single node that injects faults on a schedule.
+// The workload's transactions are recorded so that the latency during each fault window can be reported.
+type faultProxy struct {
+	target   string
+	faults   faultConfig
+	clock    clock.Clock
+	listener net.Listener
+	recorder *opRecorder
+	closed   chan struct{}
+
+	mu       sync.Mutex
+	active   bool
+	opened   time.Time
+	closesAt time.Time     // when the current fault window closes, or zero if it stays open
+	healed   chan struct{} // closed when the current fault window closes
+	conns    map[net.Conn]struct{}
+}
+
+// startFaultProxy listens on a random local port and forwards connections to target, injecting faults according to schedule.
+func startFaultProxy(target string, faults faultConfig, schedule faultSchedule) (*faultProxy, error) {
+	return startFaultProxyWithClock(target, faults, schedule, clock.Real)
+}
+
+// startFaultProxyWithClock is startFaultProxy with the schedule and delays timed by clock.
+func startFaultProxyWithClock(target string, faults faultConfig, schedule faultSchedule, c clock.Clock) (*faultProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &faultProxy{
+		target:   target,
+		faults:   faults,
+		clock:    c,
+		listener: listener,
+		recorder: startRecording(),
+		closed:   make(chan struct{}),
+		healed:   make(chan struct{}),
+		conns:    map[net.Conn]struct{}{},
+	}
+	go p.accept()
+	go p.schedule(schedule)
+	return p, nil
+}
+
+// addr is the address clients connect to instead of the target.
+func (p *faultProxy) addr() string { return p.listener.Addr().String() }
+
+// close stops the proxy, reporting the workload's latency if a fault window is still open.
+func (p *faultProxy) close() {
+	p.recorder.stop()
+	close(p.closed)
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active {
+		say("Fault window still open after %s: %s", p.clock.Now().Sub(p.opened), summarizeLatencies(p.recorder.samplesBetween(p.opened, p.clock.Now())))
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *faultProxy) accept() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *faultProxy) forward(client net.Conn) {
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		say("Fault proxy could not connect to %s: %v", p.target, err)
+		client.Close()
+		return
+	}
+	if !p.track(client, server) {
+		return
+	}
+	defer p.untrack(client, server)
+	done := make(chan struct{}, 2)
+	go func() { p.pipe(server, client); done <- struct{}{} }()
+	go func() { p.pipe(client, server); done <- struct{}{} }()
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+}
+
+func (p *faultProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	default:
+	}
+	for _, conn := range conns {
+		p.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (p *faultProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range conns {
+		delete(p.conns, conn)
+	}
+}
+
+// pipe copies src to dst, delaying each chunk while a fault window is open.
+func (p *faultProxy) pipe(dst, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !p.delay(n) {
+				return
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// delay blocks for as long as the current faults hold up a chunk of n bytes.
+// It returns false if the proxy was closed in the meantime.
+func (p *faultProxy) delay(n int) bool {
+	p.mu.Lock()
+	active, healed, closesAt := p.active, p.healed, p.closesAt
+	p.mu.Unlock()
+	if !active {
+		return true
+	}
+	if p.faults.partition {
+		// The chunk is held until the window closes, after which it is forwarded without further faults.
+		var closes <-chan time.Time
+		if !closesAt.IsZero() {
+			closes = p.clock.After(closesAt.Sub(p.clock.Now()))
+		}
+		select {
+		case <-closes:
+		case <-healed:
+		case <-p.closed:
+			return false
+		}
+		return true
+	}
+	d := p.faults.latency
+	if p.faults.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.faults.jitter) + 1))
+	}
+	if p.faults.bandwidth > 0 {
+		d += time.Duration(n) * time.Second / time.Duration(p.faults.bandwidth)
+	}
+	if d == 0 {
+		return true
+	}
+	select {
+	case <-p.clock.After(d):
+		return true
+	case <-p.closed:
+		return false
+	}
+}
+
+// sleepUntil waits until t and returns false if the proxy was closed first.
+func (p *faultProxy) sleepUntil(t time.Time) bool {
+	select {
+	case <-p.clock.After(t.Sub(p.clock.Now())):
+		return true
+	case <-p.closed:
+		return false
+	}
+}
+
+// schedule opens and closes the fault windows and reports the workload's latency around each of them.
+func (p *faultProxy) schedule(s faultSchedule) {
+	begin := p.clock.Now()
+	healthySince := begin
+	for i := 0; ; i++ {
+		openAt, closeAt, ok := s.window(i)
+		if !ok || !p.sleepUntil(begin.Add(openAt)) {
+			return
+		}
+		opened := p.clock.Now()
+		say("Workload before fault window %d: %s", i+1, summarizeLatencies(p.recorder.samplesBetween(healthySince, opened)))
+		say("Fault window %d opened (%s)", i+1, p.faults)
+		var closesAt time.Time
+		if s.duration > 0 {
+			closesAt = begin.Add(closeAt)
+		}
+		p.open(opened, closesAt)
+		if s.duration == 0 {
+			return
+		}
+		if !p.sleepUntil(begin.Add(closeAt)) {
+			return
+		}
+		p.heal()
+		healthySince = p.clock.Now()
+		say("Fault window %d closed after %s: %s", i+1, healthySince.Sub(opened), summarizeLatencies(p.recorder.samplesBetween(opened, healthySince)))
+		p.recorder.discardBefore(healthySince)
+	}
+}
+
+func (p *faultProxy) open(now, closesAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = true
+	p.opened = now
+	p.closesAt = closesAt
+	if !p.faults.reset {
+		return
+	}
+	for conn := range p.conns {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			// Discard unsent data and send a RST rather than a FIN.
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+func (p *faultProxy) heal() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = false
+	close(p.healed)
+	p.healed = make(chan struct{})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// grantStyle determines how allowUserAccessToResource and allowGroupAccessToResource grant actions:
+// select looks up the IDs and the ACE and then updates or inserts it in one transaction per action,
+// while upsert grants all actions with a single INSERT ... ON CONFLICT DO UPDATE statement.
+var grantStyle = "select"
+
+// grantedActions are the actions allowUserAccessToResource and allowGroupAccessToResource grant.
+var grantedActions = []string{"create", "read", "update", "delete"}
+
+// The upsert statements resolve the IDs with a join and rely on the user_resource_unique and
+// group_resource_unique constraints to find an existing ACE, to which the actions are appended.
+const (
+	upsertUserGrantQuery = `INSERT INTO aces (user_id, group_id, resource_id, actions)
+SELECT users.id, NULL, resources.id, $3 FROM users, resources WHERE users.uid %[1]s $1 AND resources.rid %[1]s $2
+ON CONFLICT (user_id, resource_id) DO UPDATE SET actions = aces.actions || ',' || excluded.actions`
+	upsertGroupGrantQuery = `INSERT INTO aces (user_id, group_id, resource_id, actions)
+SELECT NULL, groups.id, resources.id, $3 FROM groups, resources WHERE groups.gid %[1]s $1 AND resources.rid %[1]s $2
+ON CONFLICT (group_id, resource_id) DO UPDATE SET actions = aces.actions || ',' || excluded.actions`
+)
+
+// upsertUserGrant adds actions to the ACE of the user for resource, creating the ACE if necessary.
+func upsertUserGrant(db *sql.DB, resource string, uid int, actions []string) error {
+	return upsertGrant(db, fmt.Sprintf(upsertUserGrantQuery, lookupOp()), strconv.Itoa(uid), resource, actions)
+}
+
+// upsertGroupGrant adds actions to the ACE of the group for resource, creating the ACE if necessary.
+func upsertGroupGrant(db *sql.DB, resource string, gid int, actions []string) error {
+	return upsertGrant(db, fmt.Sprintf(upsertGroupGrantQuery, lookupOp()), strconv.Itoa(gid), resource, actions)
+}
+
+func upsertGrant(db *sql.DB, query, principal, resource string, actions []string) error {
+	result, err := execSingleResult(db, query, principal, resource, strings.Join(actions, ","))
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// The principal or the resource doesn't exist, which the select path reports the same way.
+		return sql.ErrNoRows
+	}
+	return nil
+}
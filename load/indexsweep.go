@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gpaul/cockroachload/queries"
+)
+
+// An indexCandidate is a secondary index that the index sweep evaluates, e.g. "aces (resource_id) STORING (actions)".
+type indexCandidate struct {
+	table string
+	// def is everything following the table name in CREATE INDEX ... ON <table>.
+	def string
+	// columns are the indexed and stored columns.
+	columns []string
+}
+
+func (c indexCandidate) String() string { return c.table + " " + c.def }
+
+var candidateRE = regexp.MustCompile(`^(\w+)\s*\(([^)]*)\)\s*(?:STORING\s*\(([^)]*)\))?\s*$`)
+
+func parseIndexCandidate(line string) (indexCandidate, error) {
+	m := candidateRE.FindStringSubmatch(line)
+	if m == nil {
+		return indexCandidate{}, fmt.Errorf("invalid index candidate %q: expected <table> (<columns>) [STORING (<columns>)]", line)
+	}
+	c := indexCandidate{table: m[1], def: strings.TrimSpace(line[len(m[1]):])}
+	for _, list := range []string{m[2], m[3]} {
+		for _, col := range strings.Split(list, ",") {
+			if fields := strings.Fields(col); len(fields) > 0 {
+				c.columns = append(c.columns, fields[0])
+			}
+		}
+	}
+	return c, nil
+}
+
+// readIndexCandidates reads one candidate per line, ignoring blank lines and lines starting with #.
+func readIndexCandidates(path string) ([]indexCandidate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var candidates []indexCandidate
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseIndexCandidate(line)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, scanner.Err()
+}
+
+// indexCombinations returns every combination of up to k candidate indexes, each as a list of indexes into candidates.
+func indexCombinations(n, k int) [][]int {
+	var result [][]int
+	var combine func(start int, combo []int)
+	combine = func(start int, combo []int) {
+		if len(combo) > 0 {
+			result = append(result, append([]int(nil), combo...))
+		}
+		if len(combo) == k {
+			return
+		}
+		for idx := start; idx < n; idx++ {
+			combine(idx+1, append(combo, idx))
+		}
+	}
+	combine(0, nil)
+	return result
+}
+
+// sweepRead is a read statement issued by load or joinquery, along with a function that generates arguments for it.
+type sweepRead struct {
+	name  string
+	query string
+	args  func(s *sweepData) []interface{}
+}
+
+// sweepData holds the IDs of the loaded records, from which the workload draws its arguments using rng.
+type sweepData struct {
+	counts                    recordCount
+	userIds, groupIds, resIds []int64
+	rids                      []string
+	rng                       *rand.Rand
+}
+
+func (s *sweepData) uid() string { return strconv.Itoa(s.rng.Intn(s.counts[Users])) }
+
+func (s *sweepData) gid() string { return strconv.Itoa(s.rng.Intn(s.counts[Groups])) }
+
+func (s *sweepData) rid() string { return s.rids[s.rng.Intn(len(s.rids))] }
+
+func (s *sweepData) id(ids []int64) int64 { return ids[s.rng.Intn(len(ids))] }
+
+// sweepReads returns the lookups performed by load and the joins performed by joinquery.
+func sweepReads() []sweepRead {
+	return []sweepRead{
+		{"find user", fmt.Sprintf("SELECT id from users where users.uid %s $1", lookupOp()),
+			func(s *sweepData) []interface{} { return []interface{}{s.uid()} }},
+		{"find group", fmt.Sprintf("SELECT id from groups where groups.gid %s $1", lookupOp()),
+			func(s *sweepData) []interface{} { return []interface{}{s.gid()} }},
+		{"find resource", fmt.Sprintf("SELECT resources.id as id from resources where resources.rid %s $1", lookupOp()),
+			func(s *sweepData) []interface{} { return []interface{}{s.rid()} }},
+		{"find user ace", "SELECT aces.actions as actions, aces.id as id from aces where aces.user_id = $1 and aces.resource_id = $2",
+			func(s *sweepData) []interface{} { return []interface{}{s.id(s.userIds), s.id(s.resIds)} }},
+		{"find group ace", "SELECT aces.actions as actions, aces.id as id from aces where aces.group_id = $1 and aces.resource_id = $2",
+			func(s *sweepData) []interface{} { return []interface{}{s.id(s.groupIds), s.id(s.resIds)} }},
+		{"user acl", queries.UserACL,
+			func(s *sweepData) []interface{} { return []interface{}{s.uid()} }},
+		{"check access", queries.CheckAccess,
+			func(s *sweepData) []interface{} { return []interface{}{s.uid(), s.rid()} }},
+		{"resource principals", queries.ResourcePrincipals,
+			func(s *sweepData) []interface{} { return []interface{}{s.rid()} }},
+	}
+}
+
+// A sweepQuery is a read statement of the fixed workload along with its arguments.
+type sweepQuery struct {
+	name, query string
+	args        []interface{}
+}
+
+// A sweepWrite is a round of writes of the fixed workload: a resource that is added, granted to user and group
+// and removed again, and, if moveUser isn't negative, a user that is moved to moveGroup.
+type sweepWrite struct {
+	resource            string
+	user, group         int
+	moveUser, moveGroup int
+}
+
+// A sweepWorkload is the fixed workload run for every combination of candidates.
+// It is drawn once, so that every combination is measured with the same operations.
+type sweepWorkload struct {
+	reads  []sweepQuery
+	writes []sweepWrite
+}
+
+// newSweepWorkload draws a workload that runs every read statement reads times and performs writes rounds of writes.
+func newSweepWorkload(data *sweepData, reads, writes int) *sweepWorkload {
+	w := &sweepWorkload{}
+	for _, read := range sweepReads() {
+		for ii := 0; ii < reads; ii++ {
+			w.reads = append(w.reads, sweepQuery{read.name, read.query, read.args(data)})
+		}
+	}
+	for ii := 0; ii < writes; ii++ {
+		write := sweepWrite{
+			resource: "sweep-resource-" + strconv.Itoa(ii),
+			user:     data.rng.Intn(data.counts[Users]),
+			group:    data.rng.Intn(data.counts[Groups]),
+			moveUser: -1,
+		}
+		if data.counts[Members] > 0 && data.counts[Groups] > 1 {
+			write.moveUser, write.moveGroup = data.rng.Intn(data.counts[Users]), data.rng.Intn(data.counts[Groups])
+		}
+		w.writes = append(w.writes, write)
+	}
+	return w
+}
+
+// sweepResult is the outcome of running the fixed workload with a set of candidate indexes in place.
+// For the baseline without candidates, storageBytes is the estimated size of the loaded data.
+type sweepResult struct {
+	indexes      []indexCandidate
+	read, write  time.Duration
+	storageBytes int64
+}
+
+func (r sweepResult) readImprovement(base sweepResult) float64 {
+	return 1 - float64(r.read)/float64(base.read)
+}
+
+func (r sweepResult) writeOverhead(base sweepResult) float64 {
+	return float64(r.write)/float64(base.write) - 1
+}
+
+func (r sweepResult) storageOverhead(base sweepResult) float64 {
+	if base.storageBytes == 0 {
+		return 0
+	}
+	return float64(r.storageBytes) / float64(base.storageBytes)
+}
+
+// score weighs the read improvement against the write overhead and, by storageWeight, the storage overhead.
+func (r sweepResult) score(base sweepResult, storageWeight float64) float64 {
+	return r.readImprovement(base) - r.writeOverhead(base) - storageWeight*r.storageOverhead(base)
+}
+
+// sweepIndexes applies every combination of up to k candidates in turn, runs a fixed read and write workload drawn
+// from seed against the data set described by counts and ranks the combinations by their score: the read latency improvement
+// minus the write overhead and storageWeight times the size of the indexes relative to the loaded data.
+func sweepIndexes(db *sql.DB, counts recordCount, candidates []indexCandidate, k, reads, writes int, storageWeight float64, seed int64) (err error) {
+	if counts[Users] == 0 || counts[Groups] == 0 || counts[UserPermissions] == 0 {
+		return fmt.Errorf("the index sweep needs users, groups and user permissions, got %s", counts)
+	}
+	if !counts.sane() {
+		return fmt.Errorf("the index sweep needs a sensible data mixture, got %s", counts)
+	}
+	defer func() {
+		if cerr := removeData(db); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if err := logTiming("Loading data", func() error {
+		return prepareData(db, counts)
+	}); err != nil {
+		return err
+	}
+	data := &sweepData{counts: counts, rng: rand.New(rand.NewSource(seed))}
+	for _, ids := range []struct {
+		dest  *[]int64
+		query string
+	}{
+		{&data.userIds, "SELECT id FROM users ORDER BY id"},
+		{&data.groupIds, "SELECT id FROM groups ORDER BY id"},
+		{&data.resIds, "SELECT id FROM resources ORDER BY id"},
+	} {
+		if *ids.dest, err = queryInts(db, ids.query); err != nil {
+			return err
+		}
+	}
+	if data.rids, err = findResources(db); err != nil {
+		return err
+	}
+	sort.Strings(data.rids)
+	workload := newSweepWorkload(data, reads, writes)
+	// Sizes are only estimated if they count towards the score.
+	measureStorage := storageWeight != 0
+
+	var base sweepResult
+	if err := logTiming("Running workload without candidate indexes", func() error {
+		base, err = runSweepWorkload(db, workload)
+		return err
+	}); err != nil {
+		return err
+	}
+	if measureStorage {
+		if base.storageBytes, err = estimateDataSize(db); err != nil {
+			return err
+		}
+	}
+	var results []sweepResult
+	for _, combo := range indexCombinations(len(candidates), k) {
+		indexes := make([]indexCandidate, len(combo))
+		for idx, c := range combo {
+			indexes[idx] = candidates[c]
+		}
+		var result sweepResult
+		if err := logTiming(fmt.Sprintf("Running workload with %s", describeIndexes(indexes)), func() error {
+			result, err = runWithIndexes(db, workload, indexes, measureStorage)
+			return err
+		}); err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score(base, storageWeight) > results[j].score(base, storageWeight)
+	})
+	baseline := fmt.Sprintf("Baseline: reads %s, writes %s", base.read, base.write)
+	if measureStorage {
+		baseline += fmt.Sprintf(", estimated data size %d bytes", base.storageBytes)
+	}
+	say("%s", baseline)
+	for rank, r := range results {
+		line := fmt.Sprintf("%d. %s: score %+.3f, reads %s (%+.1f%%), writes %s (%+.1f%%)",
+			rank+1, describeIndexes(r.indexes), r.score(base, storageWeight), r.read, -100*r.readImprovement(base),
+			r.write, 100*r.writeOverhead(base))
+		if measureStorage {
+			line += fmt.Sprintf(", estimated storage %d bytes (%+.1f%%)", r.storageBytes, 100*r.storageOverhead(base))
+		}
+		say("%s", line)
+	}
+	return nil
+}
+
+func describeIndexes(indexes []indexCandidate) string {
+	descs := make([]string, len(indexes))
+	for idx, index := range indexes {
+		descs[idx] = index.String()
+	}
+	return strings.Join(descs, " + ")
+}
+
+// runWithIndexes creates the indexes, runs the workload, estimates the size of the indexes if measureStorage is set
+// and drops the indexes again.
+func runWithIndexes(db *sql.DB, workload *sweepWorkload, indexes []indexCandidate, measureStorage bool) (result sweepResult, err error) {
+	var created []string
+	defer func() {
+		for _, name := range created {
+			if _, derr := db.Exec("DROP INDEX " + name); derr != nil && err == nil {
+				err = derr
+			}
+		}
+	}()
+	for idx, index := range indexes {
+		name := fmt.Sprintf("sweep_candidate_%d", idx)
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s %s", name, index.table, index.def)); err != nil {
+			return result, err
+		}
+		created = append(created, index.table+"@"+name)
+	}
+	result, err = runSweepWorkload(db, workload)
+	result.indexes = indexes
+	if !measureStorage {
+		return result, err
+	}
+	for _, index := range indexes {
+		size, serr := estimateIndexSize(db, index)
+		if serr != nil && err == nil {
+			err = serr
+		}
+		result.storageBytes += size
+	}
+	return result, err
+}
+
+// runSweepWorkload runs the workload's reads and then its rounds of writes, which touch every table the candidates
+// may index: add a resource, grant it to a user and a group, move a user between groups and remove the resource.
+// Afterwards the moved users are moved back, so the data is the same for the next run.
+func runSweepWorkload(db *sql.DB, workload *sweepWorkload) (result sweepResult, err error) {
+	t := time.Now()
+	for _, read := range workload.reads {
+		rows, err := db.Query(read.query, read.args...)
+		if err != nil {
+			return result, fmt.Errorf("%s: %v", read.name, err)
+		}
+		for rows.Next() {
+			// we ignore the actual data but iterate over the rows to make sure we pull all results from the database.
+		}
+		if err := rows.Err(); err != nil {
+			return result, fmt.Errorf("%s: %v", read.name, err)
+		}
+	}
+	result.read = time.Since(t)
+
+	var moves []membershipMove
+	defer func() {
+		for idx := len(moves) - 1; idx >= 0; idx-- {
+			if uerr := undoMove(db, moves[idx]); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+	}()
+	t = time.Now()
+	for _, write := range workload.writes {
+		if err := addResource(db, write.resource); err != nil {
+			return result, err
+		}
+		if err := allowUserAccessToResource(db, write.resource, write.user); err != nil {
+			return result, err
+		}
+		if err := allowGroupAccessToResource(db, write.resource, write.group); err != nil {
+			return result, err
+		}
+		if write.moveUser >= 0 {
+			move, err := moveUserToGroup(db, write.moveUser, write.moveGroup)
+			if err != nil {
+				return result, err
+			}
+			if move != nil {
+				moves = append(moves, *move)
+			}
+		}
+		if err := removeResource(db, write.resource); err != nil {
+			return result, err
+		}
+	}
+	result.write = time.Since(t)
+	return result, nil
+}
+
+// estimateIndexSize estimates the size of an index as the number of rows of its table times the average width of the
+// indexed and stored columns and the table's primary key columns. It ignores key prefixes and storage overhead,
+// so it is only useful for comparing candidates against each other and the loaded data.
+func estimateIndexSize(db *sql.DB, index indexCandidate) (int64, error) {
+	keyColumns, err := primaryKeyColumns(db, index.table)
+	if err != nil {
+		return 0, err
+	}
+	rowCount, widths, err := columnWidths(db, index.table)
+	if err != nil {
+		return 0, err
+	}
+	columns := map[string]bool{}
+	for _, col := range append(keyColumns, index.columns...) {
+		columns[col] = true
+	}
+	var width int64
+	for col := range columns {
+		width += columnWidth(widths, col)
+	}
+	return rowCount * width, nil
+}
+
+// estimateDataSize estimates the size of the loaded data, i.e. of the primary index of every table, as the number
+// of rows of each table times the average width of its columns, including those of the primary key.
+func estimateDataSize(db *sql.DB) (int64, error) {
+	var size int64
+	for _, table := range tables {
+		keyColumns, err := primaryKeyColumns(db, table)
+		if err != nil {
+			return 0, err
+		}
+		rowCount, widths, err := columnWidths(db, table)
+		if err != nil {
+			return 0, err
+		}
+		var width int64
+		for _, w := range widths {
+			width += w
+		}
+		for _, col := range keyColumns {
+			if _, ok := widths[col]; !ok {
+				// A hidden rowid key isn't listed among the columns.
+				width += columnWidth(widths, col)
+			}
+		}
+		size += rowCount * width
+	}
+	return size, nil
+}
+
+// fixedWidths are the estimated widths in bytes of the column types whose width doesn't depend on the value.
+var fixedWidths = map[string]int64{
+	"BOOL":      1,
+	"INT":       8,
+	"INT8":      8,
+	"INTEGER":   8,
+	"SERIAL":    8,
+	"FLOAT":     8,
+	"DECIMAL":   16,
+	"DATE":      8,
+	"TIMESTAMP": 12,
+	"INTERVAL":  24,
+}
+
+// defaultWidth is the width assumed for columns of other types and for columns that aren't listed, like a hidden rowid.
+const defaultWidth = 8
+
+func columnWidth(widths map[string]int64, column string) int64 {
+	if w, ok := widths[column]; ok {
+		return w
+	}
+	return defaultWidth
+}
+
+// columnWidths returns the number of rows of table and the estimated width in bytes of each of its columns:
+// the average length of string and bytes columns and a fixed width by type for the others.
+// It only uses SHOW COLUMNS and aggregates, so it works with CockroachDB 1.0.
+func columnWidths(db *sql.DB, table string) (rowCount int64, widths map[string]int64, err error) {
+	if err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&rowCount); err != nil {
+		return 0, nil, err
+	}
+	columns, err := showRows(db, "SHOW COLUMNS FROM "+table)
+	if err != nil {
+		return 0, nil, err
+	}
+	widths = map[string]int64{}
+	for _, col := range columns {
+		name, typ := showField(col, "field", "column_name"), strings.ToUpper(showField(col, "type", "data_type"))
+		if idx := strings.IndexAny(typ, "( "); idx >= 0 {
+			typ = typ[:idx]
+		}
+		if w, ok := fixedWidths[typ]; ok {
+			widths[name] = w
+			continue
+		}
+		if typ != "STRING" && typ != "TEXT" && typ != "VARCHAR" && typ != "CHAR" && typ != "BYTES" {
+			widths[name] = defaultWidth
+			continue
+		}
+		var avg sql.NullFloat64
+		if err := db.QueryRow(fmt.Sprintf("SELECT avg(length(%s)) FROM %s", name, table)).Scan(&avg); err != nil {
+			return 0, nil, err
+		}
+		widths[name] = int64(avg.Float64 + 0.5)
+	}
+	return rowCount, widths, nil
+}
+
+// primaryKeyColumns returns the columns of the primary key of table, as listed by SHOW INDEX.
+func primaryKeyColumns(db *sql.DB, table string) ([]string, error) {
+	indexes, err := showRows(db, "SHOW INDEX FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, index := range indexes {
+		// Since CockroachDB 22.1, primary indexes are named after their table.
+		if name := showField(index, "name", "index_name"); name != "primary" && name != table+"_pkey" {
+			continue
+		}
+		if storing := showField(index, "storing"); storing == "true" {
+			continue
+		}
+		columns = append(columns, showField(index, "column", "column_name"))
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no primary key found for %s", table)
+	}
+	return columns, nil
+}
+
+// showRows returns the rows of a SHOW statement keyed by lowercase column name,
+// since the column names differ between CockroachDB versions.
+func showRows(db *sql.DB, stmt string) ([]map[string]string, error) {
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(names))
+		dest := make([]interface{}, len(names))
+		for idx := range values {
+			dest[idx] = &values[idx]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := map[string]string{}
+		for idx, name := range names {
+			row[strings.ToLower(name)] = values[idx].String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// showField returns the first of the given columns present in row.
+func showField(row map[string]string, columns ...string) string {
+	for _, col := range columns {
+		if v, ok := row[col]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func queryInts(db *sql.DB, query string) ([]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []int64
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, rows.Err()
+}
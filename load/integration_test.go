@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/dbtest"
+	"github.com/lib/pq"
+)
+
+// newTestDB starts a single-node cluster and creates the schema in it.
+// The test is skipped unless $COCKROACH_BINARY names a cockroach binary.
+func newTestDB(t *testing.T) *sql.DB {
+	db := dbtest.Cockroach(t)
+	if err := executeTx(db, createSchema); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+var testCounts = recordCount{Users: 6, Groups: 3, Members: 2, UserPermissions: 2, GroupPermissions: 2}
+
+func TestRunWithCounts(t *testing.T) {
+	db := newTestDB(t)
+	defer func(v bool) { verifyData = v }(verifyData)
+	verifyData = true
+	if err := runWithCounts(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaVariantsLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer selectSchema("default")
+	for name := range schemaVariants {
+		t.Run(name, func(t *testing.T) {
+			if err := selectSchema(name); err != nil {
+				t.Fatal(err)
+			}
+			if err := executeTx(db, createSchema); err != nil {
+				// An older binary rejects the variant's DDL as a syntax error or an unsupported feature.
+				if pqErr, ok := err.(*pq.Error); !ok || activeSchema.requires == "" || (pqErr.Code != "42601" && pqErr.Code != "0A000") {
+					t.Fatal(err)
+				}
+				t.Skipf("schema variant %s requires CockroachDB %s: %v", name, activeSchema.requires, err)
+			}
+			if err := prepareData(db, testCounts); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyDataset(db, testCounts); err != nil {
+				t.Fatal(err)
+			}
+			if err := removeData(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkEmpty(db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStatementModesLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer selectStatementMode("adhoc")
+	for _, mode := range statementModes {
+		t.Run(mode, func(t *testing.T) {
+			if err := selectStatementMode(mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := runWithCounts(db, testCounts); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestImplicitTxnsLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer func(implicit bool) { implicitTxns = implicit }(implicitTxns)
+	implicitTxns = true
+	if err := runWithCounts(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertGrantsLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer func(style, schema string) { grantStyle = style; selectSchema(schema) }(grantStyle, schemaName)
+	grantStyle = "upsert"
+	defer func(v bool) { verifyData = v }(verifyData)
+	verifyData = true
+	for _, name := range []string{"default", "storing", "interleaved"} {
+		t.Run(name, func(t *testing.T) {
+			if err := selectSchema(name); err != nil {
+				t.Fatal(err)
+			}
+			if err := executeTx(db, createSchema); err != nil {
+				t.Fatal(err)
+			}
+			if err := runWithCounts(db, testCounts); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCleanupStrategiesLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer selectCleanupStrategy("per-record")
+	for _, strategy := range cleanupStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			if err := selectCleanupStrategy(strategy); err != nil {
+				t.Fatal(err)
+			}
+			if err := prepareData(db, testCounts); err != nil {
+				t.Fatal(err)
+			}
+			if err := removeData(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := checkEmpty(db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerifyDatasetReportsViolations(t *testing.T) {
+	db := newTestDB(t)
+	if err := prepareData(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+	defer removeData(db)
+	if _, err := db.Exec("INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES (NULL, NULL, NULL, 'read,read')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDataset(db, testCounts); err == nil {
+		t.Fatal("verifying a data set with an invalid ACE succeeded")
+	}
+	if _, err := db.Exec("DELETE FROM aces WHERE resource_id IS NULL"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckEmptyReportsLeftovers(t *testing.T) {
+	db := newTestDB(t)
+	if err := checkEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO configs (key, value) VALUES ('k', 'v')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEmpty(db); err == nil {
+		t.Fatal("checkEmpty succeeded with a row in configs")
+	}
+}
+
+func TestChurnMemberships(t *testing.T) {
+	db := newTestDB(t)
+	if err := prepareData(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+	defer removeData(db)
+	defer func(d time.Duration, r int) { churnDuration, churnRate = d, r }(churnDuration, churnRate)
+	churnDuration, churnRate = 500*time.Millisecond, 50
+	if err := churnMemberships(db, testCounts[Users], testCounts[Groups]); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDataset(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckLostUpdates(t *testing.T) {
+	db := newTestDB(t)
+	if err := checkLostUpdates(db, 4, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaChangeUnderLoad(t *testing.T) {
+	db := newTestDB(t)
+	defer removeData(db)
+	phase := startSchemaChange(db, "CREATE INDEX aces_resource_id_idx ON aces (resource_id)", 10*time.Millisecond)
+	if err := prepareData(db, testCounts); err != nil {
+		t.Fatal(err)
+	}
+	if err := phase.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(phase.recorder.samples) == 0 {
+		t.Fatal("no workload transactions were recorded")
+	}
+}
+
+func TestSweepIndexes(t *testing.T) {
+	db := newTestDB(t)
+	dir, err := ioutil.TempDir("", "indexsweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "candidates.txt")
+	if err := ioutil.WriteFile(path, []byte("# candidates\naces (resource_id)\nuser_groups (group_id)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := readIndexCandidates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("read %d candidates, want 2", len(candidates))
+	}
+	if err := sweepIndexes(db, testCounts, candidates, 2, 2, 1, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEmpty(db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/gpaul/cockroachload/chaos"
+	"github.com/gpaul/cockroachload/discovery"
+	"github.com/gpaul/cockroachload/pool"
 )
 
 const schema = `
@@ -80,19 +83,87 @@ CREATE TABLE users (
 
 var verbose bool
 
+// lookupStyle determines the operator used to find users, groups and resources by their string ID.
+// The IDs are always exact, so "eq" is what an ORM would issue while "like" is what this tool historically used.
+var lookupStyle = "like"
+
+func lookupOp() string {
+	if lookupStyle == "eq" {
+		return "="
+	}
+	return "LIKE"
+}
+
+// runTags describes the options that influence the timings of a run, so that log lines of different runs can be told apart.
+func runTags() string {
+	return fmt.Sprintf("lookup=%s, schema=%s, statements=%s, implicit-txns=%t, grants=%s", lookupStyle, schemaName, statementMode, implicitTxns, grantStyle)
+}
+
 func main() {
 	var (
-		addrF             string
-		tlsKeyFileF       string
-		tlsCertFileF      string
-		tlsCACertFileF    string
-		customF           bool
-		usersF            int
-		groupsF           int
-		membersF          int
-		userPermissionsF  int
-		groupPermissionsF int
-		verboseF          bool
+		addrF              string
+		tlsKeyFileF        string
+		tlsCertFileF       string
+		tlsCACertFileF     string
+		customF            bool
+		usersF             int
+		groupsF            int
+		membersF           int
+		userPermissionsF   int
+		groupPermissionsF  int
+		churnDurationF     time.Duration
+		churnRateF         int
+		lookupF            string
+		verifyF            bool
+		warnOnLeaksF       bool
+		schemaF            string
+		lostUpdateF        bool
+		lostUpdateWorkersF int
+		lostUpdatePairsF   int
+		lostUpdateGrantsF  int
+		indexSweepF        string
+		indexSweepKF       int
+		indexSweepReadsF   int
+		indexSweepWritesF  int
+		indexSweepStorageF float64
+		indexSweepSeedF    int64
+		schemaChangeF      string
+		schemaChangeAfterF time.Duration
+		faultLatencyF      time.Duration
+		faultJitterF       time.Duration
+		faultBandwidthF    int
+		faultResetF        bool
+		faultPartitionF    bool
+		faultAfterF        time.Duration
+		faultDurationF     time.Duration
+		faultIntervalF     time.Duration
+		chaosNodesF        string
+		chaosStopF         string
+		chaosStartF        string
+		chaosAfterF        time.Duration
+		chaosDownF         time.Duration
+		chaosIntervalF     time.Duration
+		chaosRetryTimeoutF time.Duration
+		nodesFileF         string
+		nodesFilePollF     time.Duration
+		maxOpenConnsF      int
+		maxIdleConnsF      int
+		connMaxLifetimeF   time.Duration
+		poolStatsIntervalF time.Duration
+		statementsF        string
+		implicitTxnsF      bool
+		grantsF            string
+		cleanupF           string
+		cleanupBatchF      int
+		sweepTypesF        string
+		sweepStartF        int
+		sweepStepF         int
+		sweepGrowthF       float64
+		sweepMaxF          int
+		checkpointF        string
+		resultsF           string
+		resumeF            bool
+		verboseF           bool
 	)
 	flag.StringVar(&addrF, "addr", "localhost:26257", "the address of the cockroachdb instance to connect to")
 	flag.StringVar(&tlsKeyFileF, "tls-key-file", "", "the path to the root user TLS key to use, if any")
@@ -104,6 +175,58 @@ func main() {
 	flag.IntVar(&membersF, "members", 0, "number of members per group (use with -custom)")
 	flag.IntVar(&userPermissionsF, "user-permissions", 0, "number of permissions per user (use with -custom)")
 	flag.IntVar(&groupPermissionsF, "group-permissions", 0, "number of permissions per group (use with -custom)")
+	flag.DurationVar(&churnDurationF, "churn-duration", 0, "after loading data, move random users between groups for this long (0 disables the churn phase)")
+	flag.IntVar(&churnRateF, "churn-rate", 10, "maximum number of group membership moves per second during the churn phase")
+	flag.StringVar(&lookupF, "lookup", "like", "how to look up users, groups and resources by their string ID: like (LIKE $1) or eq (= $1)")
+	flag.BoolVar(&verifyF, "verify", false, "after loading data, check row counts and referential invariants")
+	flag.BoolVar(&warnOnLeaksF, "warn-on-leaks", false, "only warn instead of failing when rows are left over after removing data")
+	flag.StringVar(&schemaF, "schema", "default", "the schema variant to create: default, fk (foreign keys with ON DELETE CASCADE), fk-no-cascade, interleaved, indexed or storing")
+	flag.BoolVar(&lostUpdateF, "lost-update-check", false, "instead of loading data, grant actions concurrently and verify that no grant was lost")
+	flag.IntVar(&lostUpdateWorkersF, "lost-update-workers", 8, "number of concurrent writers (use with -lost-update-check)")
+	flag.IntVar(&lostUpdatePairsF, "lost-update-pairs", 10, "number of (principal, resource) pairs to grant to (use with -lost-update-check)")
+	flag.IntVar(&lostUpdateGrantsF, "lost-update-grants", 4, "number of actions each writer grants per pair (use with -lost-update-check)")
+	flag.StringVar(&indexSweepF, "index-sweep", "", "instead of sweeping record counts, load the -custom record counts once and rank the candidate indexes listed in this file")
+	flag.IntVar(&indexSweepKF, "index-sweep-k", 1, "evaluate combinations of up to this many candidate indexes (use with -index-sweep)")
+	flag.IntVar(&indexSweepReadsF, "index-sweep-reads", 100, "number of times each read statement is run per candidate (use with -index-sweep)")
+	flag.IntVar(&indexSweepWritesF, "index-sweep-writes", 20, "number of write rounds per candidate (use with -index-sweep)")
+	flag.Float64Var(&indexSweepStorageF, "index-sweep-storage-weight", 1, "how much the size of the candidate indexes relative to the loaded data counts against them, next to read improvement and write overhead (use with -index-sweep)")
+	flag.Int64Var(&indexSweepSeedF, "index-sweep-seed", 1, "seed from which the fixed workload is drawn, so runs with the same seed and data issue the same operations (use with -index-sweep)")
+	flag.StringVar(&schemaChangeF, "schema-change", "", "a schema change, e.g. CREATE INDEX, to run while loading data (use with -custom)")
+	flag.DurationVar(&schemaChangeAfterF, "schema-change-after", 0, "how long after loading data starts to launch the schema change (use with -schema-change)")
+	flag.DurationVar(&faultLatencyF, "fault-latency", 0, "route connections through a local proxy that delays every chunk of data in either direction by this much during fault windows")
+	flag.DurationVar(&faultJitterF, "fault-jitter", 0, "a random extra delay of up to this much per chunk of data during fault windows")
+	flag.IntVar(&faultBandwidthF, "fault-bandwidth", 0, "limit each direction of every connection to this many bytes per second during fault windows (0 is unlimited)")
+	flag.BoolVar(&faultResetF, "fault-reset", false, "reset all open connections when a fault window opens")
+	flag.BoolVar(&faultPartitionF, "fault-partition", false, "stall all traffic to the node for the duration of each fault window")
+	flag.DurationVar(&faultAfterF, "fault-after", 0, "how long after connecting the first fault window opens")
+	flag.DurationVar(&faultDurationF, "fault-duration", 0, "how long each fault window stays open (0 keeps the first window open until the program exits)")
+	flag.DurationVar(&faultIntervalF, "fault-interval", 0, "open a new fault window this often (0 opens a single window)")
+	flag.StringVar(&chaosNodesF, "chaos-nodes", "", "comma-separated list of nodes to stop and restart in turn during the workload, substituted for {node} in -chaos-stop and -chaos-start")
+	flag.StringVar(&chaosStopF, "chaos-stop", "", "shell command that stops a node, e.g. 'docker kill roach{node}' (use with -chaos-nodes)")
+	flag.StringVar(&chaosStartF, "chaos-start", "", "shell command that starts a node, e.g. 'docker start roach{node}' (use with -chaos-nodes)")
+	flag.DurationVar(&chaosAfterF, "chaos-after", time.Minute, "how long after the workload starts the first node is stopped (use with -chaos-nodes)")
+	flag.DurationVar(&chaosDownF, "chaos-down", 30*time.Second, "how long each node stays down (use with -chaos-nodes)")
+	flag.DurationVar(&chaosIntervalF, "chaos-interval", 0, "stop the next node this long after the previous one, 0 stops a single node (use with -chaos-nodes)")
+	flag.DurationVar(&chaosRetryTimeoutF, "chaos-retry-timeout", time.Minute, "how long to retry a transaction that fails because a node is down (use with -chaos-nodes)")
+	flag.StringVar(&nodesFileF, "nodes-file", "", "instead of -addr, connect to the nodes listed in this file, one host:port per line or a JSON list, which is watched for changes")
+	flag.DurationVar(&nodesFilePollF, "nodes-file-poll", 10*time.Second, "how often to check -nodes-file for changes")
+	flag.IntVar(&maxOpenConnsF, "max-open-conns", 0, "maximum number of open connections to the database (0 is unlimited)")
+	flag.IntVar(&maxIdleConnsF, "max-idle-conns", 2, "maximum number of idle connections kept open")
+	flag.DurationVar(&connMaxLifetimeF, "conn-max-lifetime", 0, "close connections after they have been open this long (0 keeps them open)")
+	flag.DurationVar(&poolStatsIntervalF, "pool-stats-interval", 0, "report open and in-use connections and waits for a connection this often (0 disables the reports)")
+	flag.StringVar(&statementsF, "statements", "adhoc", "how to send the statements of each transaction: adhoc (a string every time), tx (prepared once per transaction) or conn (prepared once per connection)")
+	flag.BoolVar(&implicitTxnsF, "implicit-txns", false, "run single-statement operations, such as adding a user, as implicit transactions retried by the client instead of with crdb.ExecuteTx")
+	flag.StringVar(&grantsF, "grants", "select", "how to grant actions on resources: select (look up the IDs and the ACE, then update or insert it, one transaction per action) or upsert (all actions in a single INSERT ... ON CONFLICT DO UPDATE)")
+	flag.StringVar(&cleanupF, "cleanup", "per-record", "how to remove the loaded data: per-record (look up and delete every user, group and resource in its own transaction), batched (DELETE ... LIMIT loops), truncate or recreate (drop and recreate the database)")
+	flag.IntVar(&cleanupBatchF, "cleanup-batch", 1000, "number of rows deleted per statement (use with -cleanup=batched)")
+	flag.StringVar(&sweepTypesF, "sweep-types", strings.Join(recordTypeNames[:], ","), "comma-separated record types whose counts the sweep varies, the others are 0")
+	flag.IntVar(&sweepStartF, "sweep-start", 0, "the record count every sweep type starts at")
+	flag.IntVar(&sweepStepF, "sweep-step", 20, "how much the sweep's baseline record count grows every round, or grows at least with -sweep-growth")
+	flag.Float64Var(&sweepGrowthF, "sweep-growth", 0, "multiply the sweep's baseline record count by this factor every round instead of adding -sweep-step (0 grows linearly)")
+	flag.IntVar(&sweepMaxF, "sweep-max", 0, "the highest record count the sweep loads, at which it stops (0 sweeps until interrupted)")
+	flag.StringVar(&checkpointF, "checkpoint", "", "after every iteration of the sweep, write the iteration, its record counts and the results file to this JSON file")
+	flag.StringVar(&resultsF, "results", "", "append the record counts and duration of every iteration of the sweep to this file as a line of JSON")
+	flag.BoolVar(&resumeF, "resume", false, "continue the sweep after the iteration recorded in -checkpoint, removing any data left in the database first")
 	flag.BoolVar(&verboseF, "verbose", false, "print detailed timing data")
 	flag.Parse()
 
@@ -111,53 +234,193 @@ func main() {
 		say("enabled verbose logging")
 		verbose = verboseF
 	}
-
-	log.Println("Connecting to cockroachdb server")
-	sslstr := "sslmode=disable"
-	if tlsKeyFileF != "" {
-		sslargs := []string{"sslmode=verify-full"}
-		sslargs = append(sslargs, "sslrootcert="+tlsCACertFileF)
-		sslargs = append(sslargs, "sslkey="+tlsKeyFileF)
-		sslargs = append(sslargs, "sslcert="+tlsCertFileF)
-		sslstr = strings.Join(sslargs, "&")
+	churnDuration = churnDurationF
+	churnRate = churnRateF
+	if err := selectSchema(schemaF); err != nil {
+		log.Fatal(err)
 	}
-	db, err := sql.Open("postgres", fmt.Sprintf("postgresql://root@%s/testdb?%s", addrF, sslstr))
-	if err != nil {
-		log.Fatal("error connecting to the database: ", err)
+	if err := selectStatementMode(statementsF); err != nil {
+		log.Fatal(err)
 	}
-
-	if err := logTiming("Creating database and schema", func() error {
-		return crdb.ExecuteTx(db, createSchema)
-	}); err != nil {
+	implicitTxns = implicitTxnsF
+	if err := selectCleanupStrategy(cleanupF); err != nil {
 		log.Fatal(err)
 	}
+	cleanupBatchSize = cleanupBatchF
+	countSweep := sweep{start: sweepStartF, step: sweepStepF, growth: sweepGrowthF, max: sweepMaxF}
+	if types, err := parseRecordTypes(sweepTypesF); err != nil {
+		log.Fatal("invalid -sweep-types: ", err)
+	} else {
+		countSweep.types = types
+	}
+	if err := countSweep.validate(); err != nil {
+		log.Fatal("invalid sweep: ", err)
+	}
+	switch grantsF {
+	case "select", "upsert":
+		grantStyle = grantsF
+	default:
+		log.Fatalf("invalid -grants %q: must be one of select, upsert", grantsF)
+	}
+	if schemaChangeF != "" && !customF {
+		log.Fatal("-schema-change requires -custom")
+	}
+	schemaChangeDDL = schemaChangeF
+	schemaChangeAfter = schemaChangeAfterF
+	verifyData = verifyF
+	warnOnLeaks = warnOnLeaksF
+	switch lookupF {
+	case "like", "eq":
+		lookupStyle = lookupF
+	default:
+		log.Fatalf("invalid -lookup %q: must be one of like, eq", lookupF)
+	}
+
+	if customF || lostUpdateF || indexSweepF != "" {
+		if checkpointF != "" || resultsF != "" || resumeF {
+			log.Fatal("-checkpoint, -results and -resume only apply to the record count sweep")
+		}
+	} else if resumeF && checkpointF == "" {
+		log.Fatal("-resume requires -checkpoint")
+	}
+	// session connects and runs the workload. Returning instead of exiting on an error lets it close the fault
+	// injection proxy, restart stopped nodes and report the final pool statistics.
+	session := func() error {
+		progress, err := openSweepProgress(checkpointF, resultsF, countSweep, resumeF)
+		if err != nil {
+			return fmt.Errorf("error opening the sweep's progress: %v", err)
+		}
+		defer progress.close()
+
+		faults := faultConfig{
+			latency:   faultLatencyF,
+			jitter:    faultJitterF,
+			bandwidth: faultBandwidthF,
+			reset:     faultResetF,
+			partition: faultPartitionF,
+		}
+		if faults.enabled() {
+			if nodesFileF != "" {
+				return fmt.Errorf("fault injection requires a single -addr and can't be combined with -nodes-file")
+			}
+			if faultPartitionF && faultDurationF == 0 {
+				return fmt.Errorf("-fault-partition requires -fault-duration")
+			}
+			proxy, err := startFaultProxy(addrF, faults, faultSchedule{after: faultAfterF, duration: faultDurationF, interval: faultIntervalF})
+			if err != nil {
+				return fmt.Errorf("error starting the fault injection proxy: %v", err)
+			}
+			defer proxy.close()
+			say("Injecting faults (%s) through a proxy for %s listening on %s", faults, addrF, proxy.addr())
+			addrF = proxy.addr()
+		}
+
+		log.Println("Connecting to cockroachdb server")
+		sslstr := "sslmode=disable"
+		if tlsKeyFileF != "" {
+			sslargs := []string{"sslmode=verify-full"}
+			sslargs = append(sslargs, "sslrootcert="+tlsCACertFileF)
+			sslargs = append(sslargs, "sslkey="+tlsKeyFileF)
+			sslargs = append(sslargs, "sslcert="+tlsCertFileF)
+			sslstr = strings.Join(sslargs, "&")
+		}
+		dsn := func(addr string) string { return fmt.Sprintf("postgresql://root@%s/testdb?%s", addr, sslstr) }
+		var db *sql.DB
+		if nodesFileF != "" {
+			nodes, err := discovery.Watch(nodesFileF, nodesFilePollF, say)
+			if err != nil {
+				return fmt.Errorf("error reading the node list: %v", err)
+			}
+			defer nodes.Close()
+			say("Connecting to the nodes listed in %s: %v", nodesFileF, nodes.List())
+			db = discovery.OpenDB(nodes, dsn)
+		} else {
+			var err error
+			db, err = sql.Open("postgres", dsn(addrF))
+			if err != nil {
+				return fmt.Errorf("error connecting to the database: %v", err)
+			}
+		}
+		poolConfig := pool.Config{MaxOpen: maxOpenConnsF, MaxIdle: maxIdleConnsF, MaxLifetime: connMaxLifetimeF}
+		poolConfig.Apply(db)
+		if poolStatsIntervalF > 0 {
+			say("Reporting connection pool statistics every %s (%s)", poolStatsIntervalF, poolConfig)
+			defer pool.Report(db, poolStatsIntervalF, say)()
+		}
+
+		if progress.next > 0 {
+			if err := logTiming("Checking for data left by the interrupted iteration", func() error {
+				return ensureEmpty(db)
+			}); err != nil {
+				return err
+			}
+		} else if err := logTiming("Creating database and schema", func() error {
+			return executeTx(db, createSchema)
+		}); err != nil {
+			return err
+		}
 
-	if customF {
 		var counts recordCount
 		counts[Users] = usersF
 		counts[Groups] = groupsF
 		counts[Members] = membersF
 		counts[UserPermissions] = userPermissionsF
 		counts[GroupPermissions] = groupPermissionsF
-		if err := logTiming("Loading data", func() error {
-			return runWithCounts(db, counts)
-		}); err != nil {
-			log.Fatal(err)
+
+		workload := func() error {
+			if lostUpdateF {
+				return logTiming("Checking for lost updates", func() error {
+					return checkLostUpdates(db, lostUpdateWorkersF, lostUpdatePairsF, lostUpdateGrantsF)
+				})
+			}
+			if indexSweepF != "" {
+				candidates, err := readIndexCandidates(indexSweepF)
+				if err != nil {
+					return err
+				}
+				return logTiming(fmt.Sprintf("Sweeping %d candidate indexes (%s)", len(candidates), runTags()), func() error {
+					return sweepIndexes(db, counts, candidates, indexSweepKF, indexSweepReadsF, indexSweepWritesF, indexSweepStorageF, indexSweepSeedF)
+				})
+			}
+			if customF {
+				return logTiming(fmt.Sprintf("Loading data (%s)", runTags()), func() error {
+					return runWithCounts(db, counts)
+				})
+			}
+			return logTiming(fmt.Sprintf("Loading data (%s, sweep=%s)", runTags(), countSweep), func() error {
+				return run(db, countSweep, progress)
+			})
+		}
+
+		if chaosNodesF != "" {
+			chaosRetryTimeout = chaosRetryTimeoutF
+			if err := startChaos(chaos.Config{
+				Nodes:    strings.Split(chaosNodesF, ","),
+				Stop:     chaosStopF,
+				Start:    chaosStartF,
+				After:    chaosAfterF,
+				Down:     chaosDownF,
+				Interval: chaosIntervalF,
+			}); err != nil {
+				return fmt.Errorf("invalid chaos phase: %v", err)
+			}
+			defer stopChaos()
 		}
-		return
+		// An interrupt ends the session like an error, so that stopped nodes are restarted and the results so far are kept.
+		return chaos.RunInterruptible(workload)
 	}
-	if err := logTiming("Loading data", func() error {
-		return run(db)
-	}); err != nil {
+	if err := session(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-var logdepth int
+// logdepth is the nesting depth of logTiming calls, by which log lines are indented.
+// Background goroutines such as the fault proxy's schedule log while it changes, so it is atomic.
+var logdepth atomic.Int32
 
 func logTiming(msg string, fn func() error) error {
-	logdepth++
-	defer func() { logdepth-- }()
+	logdepth.Add(1)
+	defer logdepth.Add(-1)
 	if verbose {
 		say("%s ... starting", msg)
 	}
@@ -184,40 +447,86 @@ func say(msg string, args ...interface{}) {
 }
 
 func logprefix(msg string) string {
-	return strings.Repeat("  ", logdepth) + msg
+	return strings.Repeat("  ", int(logdepth.Load())) + msg
 }
 
-func createSchema(tx *sql.Tx) error {
-	_, err := tx.Exec(schema)
+func createSchema(tx *txn) error {
+	_, err := tx.Tx.Exec(activeSchema.ddl)
 	return err
 }
 
-func run(db *sql.DB) error {
-	for iteration := 0; ; iteration++ {
-		counts := recordCountForIteration(iteration)
-		msg := fmt.Sprintf("Iteration %d (%s)", iteration, counts)
+// run loads the record counts of every iteration of s in turn, starting at progress.next, and records each completed iteration.
+func run(db *sql.DB, s sweep, progress *sweepProgress) error {
+	for iteration := progress.next; ; iteration++ {
+		counts, ok := s.countsForIteration(iteration)
+		if !ok {
+			say("Sweep finished after %d iterations", iteration)
+			return nil
+		}
+		msg := fmt.Sprintf("Iteration %d (%s, %s)", iteration, counts, runTags())
+		takePrepareTime()
+		start := time.Now()
 		if err := logTiming(msg, func() error {
 			return runWithCounts(db, counts)
 		}); err != nil {
 			return err
 		}
+		elapsed, preparing := time.Since(start), takePrepareTime()
+		if preparing > 0 {
+			say("Iteration %d spent %s of that preparing statements", iteration, preparing)
+		}
+		if err := progress.completed(iteration, counts, start, elapsed-preparing, preparing); err != nil {
+			return fmt.Errorf("error recording the progress of iteration %d: %v", iteration, err)
+		}
 	}
-	return nil
 }
 
-func runWithCounts(db *sql.DB, counts recordCount) error {
+func runWithCounts(db *sql.DB, counts recordCount) (err error) {
 	if !counts.sane() {
 		say("Skipping non-sensical data mixture: %s", counts)
 		return nil
 	}
 	defer func() {
-		if cerr := logTimingV("Removing data", func() error {
-			return removeData(db)
-		}); cerr != nil {
+		if cerr := removeData(db); cerr != nil {
 			panic(cerr)
 		}
+		if lerr := logTimingV("Checking for leftover data", func() error {
+			return checkEmpty(db)
+		}); lerr != nil {
+			if warnOnLeaks {
+				say("Warning: %v", lerr)
+			} else if err == nil {
+				err = lerr
+			}
+		}
 	}()
-	return prepareData(db, counts)
+	if schemaChangeDDL != "" {
+		schemaChange := startSchemaChange(db, schemaChangeDDL, schemaChangeAfter)
+		// Wait even if loading fails, so that the schema change and its recorder don't outlive the iteration.
+		defer func() {
+			if werr := logTiming("Waiting for schema change", schemaChange.wait); werr != nil && err == nil {
+				err = werr
+			}
+		}()
+	}
+	if err := prepareData(db, counts); err != nil {
+		return err
+	}
+	if verifyData {
+		if err := logTiming("Verifying data", func() error {
+			return verifyDataset(db, counts)
+		}); err != nil {
+			return err
+		}
+	}
+	if churnDuration > 0 && counts[Members] > 0 && counts[Groups] > 1 {
+		if err := logTiming("Churning group memberships", func() error {
+			return churnMemberships(db, counts[Users], counts[Groups])
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type RecordType uint
@@ -257,27 +566,6 @@ func (counts recordCount) String() string {
 		counts[Users], counts[Groups], counts[Members], counts[UserPermissions], counts[GroupPermissions])
 }
 
-// recordCountForIteration returns an array of elements, one for each RecordType, specifying how many records of that type to generate.
-// It does so by treating the returned array as a binary string, where a '1' means 'generate records for this RecordType' and '0' means
-// 'don't increment the number of records of this RecordType'.
-// An overflow is treated as "increment all record counts.
-func recordCountForIteration(iteration int) (counts recordCount) {
-	baseline := iteration >> LastRecordType
-	if baseline == iteration {
-		// This overflow scenario was already handled by the last iteration
-		return counts
-	}
-	for cidx := range counts {
-		counts[cidx] = baseline * 20
-	}
-	for rt := RecordType(0); rt < LastRecordType; rt++ {
-		if iteration&(1<<rt) != 0 {
-			counts[rt] += 20
-		}
-	}
-	return counts
-}
-
 // prepareData adds records singly, to simulate performing such a task through a non-bulk interface
 func prepareData(db *sql.DB, counts recordCount) error {
 	if !counts.sane() {
@@ -323,16 +611,13 @@ func addUsers(db *sql.DB, users int) error {
 }
 
 func addUser(db *sql.DB, userid int) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		uid := strconv.Itoa(userid)
-		passwordhash := "$6$rounds=656000$WZdTPdpxUZsDG5PG$6om6ApIm5l5639JNAUmtFD87cIXdWCAVKeJ4zNlhmPKWT3PARF6Ai.HpcjR8SPQSQnqoefBiLaZmPuMFhGhpm0"
-		utype := "regular"
-		description := "some description"
-		isRemote := false
-		_, err := tx.Exec("INSERT INTO users (uid, passwordhash, utype, description, is_remote) VALUES ($1, $2, $3, $4, $5) RETURNING users.id",
-			uid, passwordhash, utype, description, isRemote)
-		return err
-	})
+	uid := strconv.Itoa(userid)
+	passwordhash := "$6$rounds=656000$WZdTPdpxUZsDG5PG$6om6ApIm5l5639JNAUmtFD87cIXdWCAVKeJ4zNlhmPKWT3PARF6Ai.HpcjR8SPQSQnqoefBiLaZmPuMFhGhpm0"
+	utype := "regular"
+	description := "some description"
+	isRemote := false
+	return insertRecord(db, "INSERT INTO users (uid, passwordhash, utype, description, is_remote) VALUES ($1, $2, $3, $4, $5) RETURNING users.id",
+		uid, passwordhash, utype, description, isRemote)
 }
 
 func addGroups(db *sql.DB, groups int) error {
@@ -347,13 +632,10 @@ func addGroups(db *sql.DB, groups int) error {
 }
 
 func addGroup(db *sql.DB, groupid int) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		gid := strconv.Itoa(groupid)
-		description := "some description"
-		_, err := tx.Exec("INSERT INTO groups (gid, description) VALUES ($1, $2) RETURNING groups.id",
-			gid, description)
-		return err
-	})
+	gid := strconv.Itoa(groupid)
+	description := "some description"
+	return insertRecord(db, "INSERT INTO groups (gid, description) VALUES ($1, $2) RETURNING groups.id",
+		gid, description)
 }
 
 func assignUsersToGroups(db *sql.DB, members, groups, users int) error {
@@ -373,14 +655,14 @@ func assignUsersToGroups(db *sql.DB, members, groups, users int) error {
 }
 
 func addUserToGroup(db *sql.DB, group, user int) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+	return executeTx(db, func(tx *txn) error {
 		var userId int
-		row := tx.QueryRow("SELECT id from users where users.uid LIKE $1", strconv.Itoa(user))
+		row := tx.QueryRow(fmt.Sprintf("SELECT id from users where users.uid %s $1", lookupOp()), strconv.Itoa(user))
 		if err := row.Scan(&userId); err != nil {
 			return err
 		}
 		var groupId int
-		row = tx.QueryRow("SELECT id from groups where groups.gid LIKE $1", strconv.Itoa(group))
+		row = tx.QueryRow(fmt.Sprintf("SELECT id from groups where groups.gid %s $1", lookupOp()), strconv.Itoa(group))
 		if err := row.Scan(&groupId); err != nil {
 			return err
 		}
@@ -412,57 +694,69 @@ func assignUserPermissions(db *sql.DB, permissions, users int) error {
 func userResourceName(rid int) string { return "user-resource-" + strconv.Itoa(rid) }
 
 func allowUserAccessToResource(db *sql.DB, resource string, uid int) error {
-	for _, action := range []string{"create", "read", "update", "delete"} {
-		if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-			return logTimingV("inside", func() error {
-				var resourceId int64
-				if err := logTimingV("find resource "+resource, func() error {
-					row := tx.QueryRow("SELECT resources.id as id from resources where resources.rid LIKE $1", resource)
-					return row.Scan(&resourceId)
-				}); err != nil {
+	if grantStyle == "upsert" {
+		return upsertUserGrant(db, resource, uid, grantedActions)
+	}
+	for _, action := range grantedActions {
+		if err := grantUserAction(db, resource, uid, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantUserAction adds action to the ACE of the user for resource, creating the ACE if necessary.
+// It reads the current actions and writes them back, so concurrent grants rely on transaction isolation to not get lost.
+func grantUserAction(db *sql.DB, resource string, uid int, action string) error {
+	if grantStyle == "upsert" {
+		return upsertUserGrant(db, resource, uid, []string{action})
+	}
+	return executeTx(db, func(tx *txn) error {
+		return logTimingV("inside", func() error {
+			var resourceId int64
+			if err := logTimingV("find resource "+resource, func() error {
+				row := tx.QueryRow(fmt.Sprintf("SELECT resources.id as id from resources where resources.rid %s $1", lookupOp()), resource)
+				return row.Scan(&resourceId)
+			}); err != nil {
+				return err
+			}
+			var userId int64
+			if err := logTimingV("find user "+strconv.Itoa(uid), func() error {
+				row := tx.QueryRow(fmt.Sprintf("SELECT users.id as id from users where users.uid %s $1", lookupOp()), strconv.Itoa(uid))
+				return row.Scan(&userId)
+			}); err != nil {
+				return err
+			}
+			var actionstr string
+			var aceId string
+			if err := logTimingV("find ace", func() error {
+				row := tx.QueryRow("SELECT aces.actions as actions, aces.id as id from aces where aces.user_id = $1 and aces.resource_id = $2", userId, resourceId)
+				return row.Scan(&actionstr, &aceId)
+			}); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if len(actionstr) > 0 {
+				actionstr += "," + action
+				if err := logTimingV("update ace actions="+actionstr, func() error {
+					_, err := tx.Exec("UPDATE aces SET actions = $1 WHERE aces.id=$2",
+						actionstr, aceId)
 					return err
-				}
-				var userId int64
-				if err := logTimingV("find user "+strconv.Itoa(uid), func() error {
-					row := tx.QueryRow("SELECT users.id as id from users where users.uid LIKE $1", strconv.Itoa(uid))
-					return row.Scan(&userId)
 				}); err != nil {
 					return err
 				}
-				var actionstr string
-				var aceId string
-				if err := logTimingV("find ace", func() error {
-					row := tx.QueryRow("SELECT aces.actions as actions, aces.id as id from aces where aces.user_id = $1 and aces.resource_id = $2", userId, resourceId)
-					return row.Scan(&actionstr, &aceId)
-				}); err != nil && err != sql.ErrNoRows {
+			} else {
+				actionstr = action
+				if err := logTimingV("insert ace actions="+actionstr, func() error {
+					_, err := tx.Exec("INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES ($1, $2, $3, $4)",
+						userId, nil, resourceId, actionstr)
+					return err
+				}); err != nil {
 					return err
 				}
-				if len(actionstr) > 0 {
-					actionstr += "," + action
-					if err := logTimingV("update ace actions="+actionstr, func() error {
-						_, err := tx.Exec("UPDATE aces SET actions = $1 WHERE aces.id=$2",
-							actionstr, aceId)
-						return err
-					}); err != nil {
-						return err
-					}
-				} else {
-					actionstr = action
-					if err := logTimingV("insert ace actions="+actionstr, func() error {
-						_, err := tx.Exec("INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES ($1, $2, $3, $4)",
-							userId, nil, resourceId, actionstr)
-						return err
-					}); err != nil {
-						return err
-					}
-				}
-				return nil
-			})
-		}); err != nil {
-			return err
-		}
-	}
-	return nil
+			}
+			return nil
+		})
+	})
 }
 
 func assignGroupPermissions(db *sql.DB, permissions, groups int) error {
@@ -487,57 +781,65 @@ func assignGroupPermissions(db *sql.DB, permissions, groups int) error {
 func groupResourceName(rid int) string { return "group-resource-" + strconv.Itoa(rid) }
 
 func allowGroupAccessToResource(db *sql.DB, resource string, gid int) error {
-	for _, action := range []string{"create", "read", "update", "delete"} {
-		if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-			row := tx.QueryRow("SELECT resources.id as id from resources where resources.rid LIKE $1", resource)
-			var resourceId int64
-			if err := row.Scan(&resourceId); err != nil {
-				return err
-			}
-			row = tx.QueryRow("SELECT groups.id as id from groups where groups.gid LIKE $1", strconv.Itoa(gid))
-			var groupId int64
-			if err := row.Scan(&groupId); err != nil {
+	if grantStyle == "upsert" {
+		return upsertGroupGrant(db, resource, gid, grantedActions)
+	}
+	for _, action := range grantedActions {
+		if err := grantGroupAction(db, resource, gid, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantGroupAction adds action to the ACE of the group for resource, creating the ACE if necessary.
+func grantGroupAction(db *sql.DB, resource string, gid int, action string) error {
+	if grantStyle == "upsert" {
+		return upsertGroupGrant(db, resource, gid, []string{action})
+	}
+	return executeTx(db, func(tx *txn) error {
+		row := tx.QueryRow(fmt.Sprintf("SELECT resources.id as id from resources where resources.rid %s $1", lookupOp()), resource)
+		var resourceId int64
+		if err := row.Scan(&resourceId); err != nil {
+			return err
+		}
+		row = tx.QueryRow(fmt.Sprintf("SELECT groups.id as id from groups where groups.gid %s $1", lookupOp()), strconv.Itoa(gid))
+		var groupId int64
+		if err := row.Scan(&groupId); err != nil {
+			return err
+		}
+		row = tx.QueryRow("SELECT aces.actions as actions, aces.id as id from aces where aces.group_id = $1 and aces.resource_id = $2", groupId, resourceId)
+		var actionstr string
+		var aceId int64
+		err := row.Scan(&actionstr, &aceId)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if len(actionstr) > 0 {
+			actionstr += "," + action
+			if _, err := tx.Exec("UPDATE aces SET actions = $1 WHERE aces.id=$2",
+				actionstr, aceId); err != nil {
 				return err
 			}
-			row = tx.QueryRow("SELECT aces.actions as actions, aces.id as id from aces where aces.group_id = $1 and aces.resource_id = $2", groupId, resourceId)
-			var actionstr string
-			var aceId int64
-			err := row.Scan(&actionstr, &aceId)
-			if err != nil && err != sql.ErrNoRows {
+		} else {
+			actionstr = action
+			if _, err := tx.Exec("INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES ($1, $2, $3, $4)",
+				nil, groupId, resourceId, actionstr); err != nil {
 				return err
 			}
-			if len(actionstr) > 0 {
-				actionstr += "," + action
-				if _, err := tx.Exec("UPDATE aces SET actions = $1 WHERE aces.id=$2",
-					actionstr, aceId); err != nil {
-					return err
-				}
-			} else {
-				actionstr = action
-				if _, err := tx.Exec("INSERT INTO aces (user_id, group_id, resource_id, actions) VALUES ($1, $2, $3, $4)",
-					nil, groupId, resourceId, actionstr); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			return err
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 func addResource(db *sql.DB, resource string) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		description := "some description"
-		_, err := tx.Exec("INSERT INTO resources (rid, description) VALUES ($1, $2) RETURNING resources.id",
-			resource, description)
-		return err
-	})
+	description := "some description"
+	return insertRecord(db, "INSERT INTO resources (rid, description) VALUES ($1, $2) RETURNING resources.id",
+		resource, description)
 }
 
-// removeData removes records singly, to simulate performing such a task through a non-bulk interface
-func removeData(db *sql.DB) error {
+// removeRecords removes records singly, to simulate performing such a task through a non-bulk interface
+func removeRecords(db *sql.DB) error {
 	if err := logTimingV("Remove users", func() error {
 		return removeUsers(db)
 	}); err != nil {
@@ -572,7 +874,7 @@ func removeUsers(db *sql.DB) error {
 }
 
 func findUsers(db *sql.DB) (uids []string, err error) {
-	if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+	if err := executeTx(db, func(tx *txn) error {
 		rows, err := tx.Query("SELECT uid from users")
 		if err != nil {
 			return err
@@ -592,8 +894,11 @@ func findUsers(db *sql.DB) (uids []string, err error) {
 }
 
 func removeUser(db *sql.DB, uid string) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		row := tx.QueryRow("SELECT id from users where uid LIKE $1", uid)
+	if activeSchema.cascade {
+		return execSingle(db, fmt.Sprintf("DELETE FROM users where uid %s $1", lookupOp()), uid)
+	}
+	return executeTx(db, func(tx *txn) error {
+		row := tx.QueryRow(fmt.Sprintf("SELECT id from users where uid %s $1", lookupOp()), uid)
 		var id int64
 		if err := row.Scan(&id); err != nil {
 			return err
@@ -627,7 +932,7 @@ func removeGroups(db *sql.DB) error {
 }
 
 func findGroups(db *sql.DB) (gids []string, err error) {
-	if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+	if err := executeTx(db, func(tx *txn) error {
 		rows, err := tx.Query("SELECT gid from groups")
 		if err != nil {
 			return err
@@ -647,8 +952,11 @@ func findGroups(db *sql.DB) (gids []string, err error) {
 }
 
 func removeGroup(db *sql.DB, gid string) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		row := tx.QueryRow("SELECT id from groups where gid LIKE $1", gid)
+	if activeSchema.cascade {
+		return execSingle(db, fmt.Sprintf("DELETE FROM groups where gid %s $1", lookupOp()), gid)
+	}
+	return executeTx(db, func(tx *txn) error {
+		row := tx.QueryRow(fmt.Sprintf("SELECT id from groups where gid %s $1", lookupOp()), gid)
 		var id int64
 		if err := row.Scan(&id); err != nil {
 			return err
@@ -682,7 +990,7 @@ func removeResources(db *sql.DB) error {
 }
 
 func findResources(db *sql.DB) (rids []string, err error) {
-	if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+	if err := executeTx(db, func(tx *txn) error {
 		rows, err := tx.Query("SELECT rid from resources")
 		if err != nil {
 			return err
@@ -702,8 +1010,11 @@ func findResources(db *sql.DB) (rids []string, err error) {
 }
 
 func removeResource(db *sql.DB, rid string) error {
-	return crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-		row := tx.QueryRow("SELECT id from resources where rid LIKE $1", rid)
+	if activeSchema.cascade {
+		return execSingle(db, fmt.Sprintf("DELETE FROM resources where rid %s $1", lookupOp()), rid)
+	}
+	return executeTx(db, func(tx *txn) error {
+		row := tx.QueryRow(fmt.Sprintf("SELECT id from resources where rid %s $1", lookupOp()), rid)
 		var id int64
 		if err := row.Scan(&id); err != nil {
 			return err
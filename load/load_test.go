@@ -0,0 +1,619 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/chaos"
+	"github.com/gpaul/cockroachload/clock"
+	"github.com/lib/pq"
+)
+
+func TestSweepCountsForIteration(t *testing.T) {
+	// Every type takes part and gains 20 records per round, forever.
+	s := sweep{types: []RecordType{Users, Groups, Members, UserPermissions, GroupPermissions}, step: 20}
+	for _, tc := range []struct {
+		iteration int
+		want      recordCount
+	}{
+		{0, recordCount{0, 0, 0, 0, 0}},
+		{1, recordCount{20, 0, 0, 0, 0}},
+		{2, recordCount{0, 20, 0, 0, 0}},
+		{3, recordCount{20, 20, 0, 0, 0}},
+		{16, recordCount{0, 0, 0, 0, 20}},
+		{31, recordCount{20, 20, 20, 20, 20}},
+		{32, recordCount{20, 20, 20, 20, 20}},
+		{33, recordCount{40, 20, 20, 20, 20}},
+		{64, recordCount{40, 40, 40, 40, 40}},
+	} {
+		if got, ok := s.countsForIteration(tc.iteration); !ok || got != tc.want {
+			t.Errorf("countsForIteration(%d) = %s, %t, want %s", tc.iteration, got, ok, tc.want)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		sweep sweep
+		want  []recordCount
+	}{
+		{
+			name:  "bounded",
+			sweep: sweep{types: []RecordType{Users}, step: 10, max: 10},
+			want:  []recordCount{{0}, {10}},
+		},
+		{
+			name:  "start",
+			sweep: sweep{types: []RecordType{Users}, start: 50, step: 10, max: 60},
+			want:  []recordCount{{50}, {60}},
+		},
+		{
+			name:  "geometric",
+			sweep: sweep{types: []RecordType{Groups}, start: 10, step: 5, growth: 2, max: 40},
+			want:  []recordCount{{0, 10}, {0, 20}, {0, 20}, {0, 40}},
+		},
+		{
+			name:  "geometric from zero",
+			sweep: sweep{types: []RecordType{Groups}, step: 5, growth: 2.5, max: 13},
+			want:  []recordCount{{0, 0}, {0, 5}, {0, 5}, {0, 13}},
+		},
+		{
+			name:  "clamped",
+			sweep: sweep{types: []RecordType{Users, Groups}, step: 10, max: 15},
+			want:  []recordCount{{0, 0}, {10, 0}, {0, 10}, {10, 10}, {10, 10}, {15, 10}, {10, 15}, {15, 15}},
+		},
+		{
+			name:  "types",
+			sweep: sweep{types: []RecordType{Users, UserPermissions}, step: 1, max: 0},
+			want: []recordCount{
+				{0, 0, 0, 0, 0}, {1, 0, 0, 0, 0}, {0, 0, 0, 1, 0}, {1, 0, 0, 1, 0},
+				{1, 0, 0, 1, 0}, {2, 0, 0, 1, 0}, {1, 0, 0, 2, 0}, {2, 0, 0, 2, 0},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.sweep.validate(); err != nil {
+				t.Fatal(err)
+			}
+			var got []recordCount
+			for iteration := 0; iteration < len(tc.want)+1; iteration++ {
+				counts, ok := tc.sweep.countsForIteration(iteration)
+				if !ok {
+					break
+				}
+				got = append(got, counts)
+			}
+			if tc.sweep.max == 0 {
+				got = got[:len(tc.want)]
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseRecordTypes(t *testing.T) {
+	types, err := parseRecordTypes("users, group-permissions,groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []RecordType{Users, GroupPermissions, Groups}; fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", types, want)
+	}
+	for _, list := range []string{"", "users,admins", "users,users"} {
+		if _, err := parseRecordTypes(list); err == nil {
+			t.Errorf("parseRecordTypes(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestRecordCountSane(t *testing.T) {
+	for _, tc := range []struct {
+		counts recordCount
+		want   bool
+	}{
+		{recordCount{}, true},
+		{recordCount{10, 5, 5, 3, 2}, true},
+		{recordCount{10, 0, 5, 0, 0}, false},
+		{recordCount{0, 5, 5, 0, 0}, false},
+		{recordCount{4, 5, 5, 0, 0}, false},
+		{recordCount{0, 0, 0, 3, 0}, false},
+		{recordCount{0, 0, 0, 0, 3}, false},
+		{recordCount{10, 0, 0, 3, 0}, true},
+	} {
+		if got := tc.counts.sane(); got != tc.want {
+			t.Errorf("%s.sane() = %t, want %t", tc.counts, got, tc.want)
+		}
+	}
+}
+
+func TestRecordCountString(t *testing.T) {
+	want := "{users: 1, groups: 2, members: 3, user-permissions: 4, group-permissions: 5}"
+	if got := (recordCount{1, 2, 3, 4, 5}).String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestExpectedRowCounts(t *testing.T) {
+	got := expectedRowCounts(recordCount{10, 3, 2, 4, 5})
+	want := map[string]int{"users": 10, "groups": 3, "resources": 9, "user_groups": 6, "aces": 55, "configs": 0}
+	for _, table := range tables {
+		if got[table] != want[table] {
+			t.Errorf("expected %d rows in %s, want %d", got[table], table, want[table])
+		}
+	}
+}
+
+func TestLookupOp(t *testing.T) {
+	defer func(style string) { lookupStyle = style }(lookupStyle)
+	for style, want := range map[string]string{"like": "LIKE", "eq": "="} {
+		lookupStyle = style
+		if got := lookupOp(); got != want {
+			t.Errorf("lookupOp() with style %s = %q, want %q", style, got, want)
+		}
+	}
+}
+
+func TestSchemaVariants(t *testing.T) {
+	for name, variant := range schemaVariants {
+		for _, table := range tables {
+			if !strings.Contains(variant.ddl, "CREATE TABLE "+table+" (") {
+				t.Errorf("schema variant %s does not create table %s", name, table)
+			}
+		}
+	}
+	if !strings.Contains(schemaVariants["storing"].ddl, "STORING (user_id, group_id, actions)") {
+		t.Errorf("storing schema variant lacks covering index on aces")
+	}
+	if strings.Contains(schemaVariants["fk-no-cascade"].ddl, "CASCADE") {
+		t.Errorf("fk-no-cascade schema variant contains cascading deletes")
+	}
+	defer func() { selectSchema("default") }()
+	if err := selectSchema("nonexistent"); err == nil {
+		t.Errorf("selecting an unknown schema variant succeeded")
+	}
+	if err := selectSchema("fk"); err != nil || !activeSchema.cascade || schemaName != "fk" {
+		t.Errorf("selecting the fk schema variant failed: err=%v, cascade=%t, name=%s", err, activeSchema.cascade, schemaName)
+	}
+}
+
+func TestParseIndexCandidate(t *testing.T) {
+	c, err := parseIndexCandidate("aces (resource_id ASC, user_id) STORING (actions)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.table != "aces" || c.def != "(resource_id ASC, user_id) STORING (actions)" {
+		t.Errorf("parsed candidate %+v", c)
+	}
+	if got, want := strings.Join(c.columns, ","), "resource_id,user_id,actions"; got != want {
+		t.Errorf("columns = %s, want %s", got, want)
+	}
+	for _, invalid := range []string{"aces", "aces resource_id", "(resource_id)", "aces (resource_id) STORING"} {
+		if _, err := parseIndexCandidate(invalid); err == nil {
+			t.Errorf("parsing %q succeeded", invalid)
+		}
+	}
+}
+
+func TestIndexCombinations(t *testing.T) {
+	for _, tc := range []struct {
+		n, k int
+		want string
+	}{
+		{3, 1, "[[0] [1] [2]]"},
+		{3, 2, "[[0] [0 1] [0 2] [1] [1 2] [2]]"},
+		{2, 3, "[[0] [0 1] [1]]"},
+		{0, 2, "[]"},
+	} {
+		if got := fmt.Sprint(indexCombinations(tc.n, tc.k)); got != tc.want {
+			t.Errorf("indexCombinations(%d, %d) = %s, want %s", tc.n, tc.k, got, tc.want)
+		}
+	}
+}
+
+func TestSummarizeLatencies(t *testing.T) {
+	if got := summarizeLatencies(nil); got != "no operations" {
+		t.Errorf("summarizeLatencies(nil) = %q", got)
+	}
+	var samples []opSample
+	for ii := 1; ii <= 100; ii++ {
+		sample := opSample{latency: time.Duration(ii) * time.Millisecond}
+		if ii%10 == 0 {
+			sample.err = errors.New("failed")
+		}
+		samples = append(samples, sample)
+	}
+	want := "100 operations, 10 errors, mean 50.5ms, p50 50ms, p99 99ms, max 100ms"
+	if got := summarizeLatencies(samples); got != want {
+		t.Errorf("summarizeLatencies() = %q, want %q", got, want)
+	}
+	samples[0].preparing = 3 * time.Millisecond
+	if got := summarizeLatencies(samples); got != want+", plus 3ms preparing statements" {
+		t.Errorf("summarizeLatencies() = %q, want the time spent preparing reported separately", got)
+	}
+}
+
+func TestRecorderSamplesBetween(t *testing.T) {
+	r := startRecording()
+	defer r.stop()
+	base := time.Now()
+	for ii := 0; ii < 5; ii++ {
+		recordOp(opSample{start: base.Add(time.Duration(ii) * time.Second)})
+	}
+	r.stop()
+	recordOp(opSample{start: base})
+	if got := len(r.samplesBetween(base.Add(time.Second), base.Add(3*time.Second))); got != 2 {
+		t.Errorf("found %d samples between 1s and 3s, want 2", got)
+	}
+	if got := len(r.samplesBetween(base, base.Add(time.Hour))); got != 5 {
+		t.Errorf("found %d samples in total, want 5", got)
+	}
+}
+
+func TestFaultScheduleWindows(t *testing.T) {
+	for _, tc := range []struct {
+		schedule   faultSchedule
+		i          int
+		open, shut time.Duration
+		ok         bool
+	}{
+		{faultSchedule{after: time.Second}, 0, time.Second, 0, true},
+		{faultSchedule{after: time.Second}, 1, 0, 0, false},
+		{faultSchedule{after: time.Second, duration: 2 * time.Second}, 0, time.Second, 3 * time.Second, true},
+		{faultSchedule{after: time.Second, duration: 2 * time.Second}, 1, 0, 0, false},
+		{faultSchedule{after: time.Second, duration: 2 * time.Second, interval: 10 * time.Second}, 2, 21 * time.Second, 23 * time.Second, true},
+	} {
+		open, shut, ok := tc.schedule.window(tc.i)
+		if open != tc.open || shut != tc.shut || ok != tc.ok {
+			t.Errorf("%+v.window(%d) = %s, %s, %t, want %s, %s, %t", tc.schedule, tc.i, open, shut, ok, tc.open, tc.shut, tc.ok)
+		}
+	}
+}
+
+func TestFaultConfigString(t *testing.T) {
+	if got := (faultConfig{}).String(); got != "no faults" {
+		t.Errorf("got %q for no faults", got)
+	}
+	f := faultConfig{latency: 50 * time.Millisecond, bandwidth: 1024, reset: true}
+	if got, want := f.String(), "latency=50ms, bandwidth=1024B/s, reset"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// startEchoServer returns the address of a TCP server that echoes everything it receives.
+func startEchoServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func echo(conn net.Conn, msg string) error {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("echoed %q, want %q", buf, msg)
+	}
+	return nil
+}
+
+// echoAsync echoes msg in the background and delivers the result on the returned channel.
+func echoAsync(conn net.Conn, msg string) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- echo(conn, msg) }()
+	return done
+}
+
+func TestFaultProxyLatencyWindow(t *testing.T) {
+	target, stop := startEchoServer(t)
+	defer stop()
+	manual := clock.NewManual(time.Unix(0, 0))
+	latency := 50 * time.Millisecond
+	p, err := startFaultProxyWithClock(target, faultConfig{latency: latency}, faultSchedule{after: time.Second, duration: time.Second, interval: time.Hour}, manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	conn, err := net.Dial("tcp", p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The schedule waits for the window to open. Until then nothing is delayed.
+	manual.WaitForTimers(1)
+	if err := echo(conn, "before"); err != nil {
+		t.Fatalf("echo before the fault window: %v", err)
+	}
+
+	// Once the window is open, the schedule waits for it to close.
+	manual.Advance(time.Second)
+	manual.WaitForTimers(1)
+	done := echoAsync(conn, "during")
+	// The latency is added in both directions.
+	for _, direction := range []string{"request", "reply"} {
+		manual.WaitForTimers(2)
+		select {
+		case err := <-done:
+			t.Fatalf("echo during the fault window completed before the %s was delayed: %v", direction, err)
+		default:
+		}
+		manual.Advance(latency)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("echo during the fault window: %v", err)
+	}
+
+	// Once the window is closed, the schedule waits for the next one to open.
+	manual.Advance(time.Second - 2*latency)
+	manual.WaitForTimers(1)
+	if err := echo(conn, "after"); err != nil {
+		t.Fatalf("echo after the fault window: %v", err)
+	}
+}
+
+func TestFaultProxyReset(t *testing.T) {
+	target, stop := startEchoServer(t)
+	defer stop()
+	manual := clock.NewManual(time.Unix(0, 0))
+	p, err := startFaultProxyWithClock(target, faultConfig{reset: true}, faultSchedule{after: time.Second, duration: time.Hour}, manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	conn, err := net.Dial("tcp", p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "before"); err != nil {
+		t.Fatal(err)
+	}
+	manual.WaitForTimers(1)
+	manual.Advance(time.Second)
+	manual.WaitForTimers(1)
+	if err := echo(conn, "during"); err == nil {
+		t.Error("connection survived the reset")
+	}
+	conn, err = net.Dial("tcp", p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echo(conn, "reconnected"); err != nil {
+		t.Errorf("new connection after the reset failed: %v", err)
+	}
+}
+
+func TestFaultProxyPartition(t *testing.T) {
+	target, stop := startEchoServer(t)
+	defer stop()
+	manual := clock.NewManual(time.Unix(0, 0))
+	p, err := startFaultProxyWithClock(target, faultConfig{partition: true}, faultSchedule{duration: time.Second}, manual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	// The window opens right away and the schedule waits for it to close.
+	manual.WaitForTimers(1)
+	conn, err := net.Dial("tcp", p.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := echoAsync(conn, "partitioned")
+	// The request is held until the window closes.
+	manual.WaitForTimers(2)
+	select {
+	case err := <-done:
+		t.Fatalf("echo crossed the partition: %v", err)
+	default:
+	}
+	manual.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("echo after the partition healed: %v", err)
+	}
+}
+
+func TestSweepProgressResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointPath, resultsPath := filepath.Join(dir, "checkpoint.json"), filepath.Join(dir, "results.jsonl")
+	s := sweep{types: []RecordType{Users, Groups}, step: 10, max: 20}
+
+	p, err := openSweepProgress(checkpointPath, resultsPath, s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.next != 0 {
+		t.Fatalf("without a checkpoint the sweep resumes at iteration %d, want 0", p.next)
+	}
+	for iteration := 0; iteration < 2; iteration++ {
+		counts, _ := s.countsForIteration(iteration)
+		if err := p.completed(iteration, counts, time.Now(), time.Second, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Iteration 2 completes, but the run dies before the checkpoint is written.
+	if _, err := p.results.WriteString(`{"iteration": 2}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	var cp checkpoint
+	data, err := ioutil.ReadFile(checkpointPath)
+	if err == nil {
+		err = json.Unmarshal(data, &cp)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (recordCount{10, 0, 0, 0, 0}); cp.Iteration != 1 || cp.Counts != want || cp.Results != resultsPath {
+		t.Errorf("checkpoint = %+v, want iteration 1 with %s and results in %s", cp, want, resultsPath)
+	}
+
+	if _, err := openSweepProgress(checkpointPath, "", sweep{types: s.types, step: 20, max: 20}, true); err == nil {
+		t.Error("resumed a checkpoint of a different sweep")
+	}
+	p, err = openSweepProgress(checkpointPath, "", s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.next != 2 {
+		t.Errorf("resumed at iteration %d, want 2", p.next)
+	}
+	counts, _ := s.countsForIteration(2)
+	if err := p.completed(2, counts, time.Now(), time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	data, err = ioutil.ReadFile(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iterations []int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r iterationResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid result %q: %v", line, err)
+		}
+		iterations = append(iterations, r.Iteration)
+		if want, _ := s.countsForIteration(r.Iteration); r.Counts != want || r.Seconds != 1 {
+			t.Errorf("result %q, want %s taking 1s", line, want)
+		}
+	}
+	if fmt.Sprint(iterations) != "[0 1 2]" {
+		t.Errorf("results for iterations %v, want [0 1 2]", iterations)
+	}
+}
+
+func TestRunOpAppliedAfterAmbiguousFailure(t *testing.T) {
+	defer func(timeout time.Duration) { chaosRetryTimeout = timeout }(chaosRetryTimeout)
+	chaosRetryTimeout = time.Minute
+	if err := startChaos(chaos.Config{Nodes: []string{"1"}, Stop: "true", Start: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	defer stopChaos()
+	duplicate := &pq.Error{Code: "23505", Message: "duplicate key value"}
+	// The first attempt commits but loses its connection, so the retry finds the record.
+	errs := []error{io.EOF, duplicate}
+	op := func() (int, time.Duration, error) {
+		err := errs[0]
+		errs = errs[1:]
+		return 0, 0, err
+	}
+	if err := runOpApplied(op, uniqueViolation); err != nil {
+		t.Errorf("runOpApplied() = %v, want the retry's unique violation to count as success", err)
+	}
+	// Without an ambiguous failure first, a unique violation is a genuine duplicate.
+	errs = []error{duplicate}
+	if err := runOpApplied(op, uniqueViolation); err != duplicate {
+		t.Errorf("runOpApplied() = %v, want %v", err, duplicate)
+	}
+}
+
+func TestSweepResultScoreWeighsStorage(t *testing.T) {
+	base := sweepResult{read: 100 * time.Millisecond, write: 100 * time.Millisecond, storageBytes: 1000}
+	small := sweepResult{read: 50 * time.Millisecond, write: 110 * time.Millisecond, storageBytes: 100}
+	large := sweepResult{read: 50 * time.Millisecond, write: 110 * time.Millisecond, storageBytes: 800}
+	if s, l := small.score(base, 0), large.score(base, 0); s != l {
+		t.Errorf("without a storage weight the scores differ: %f and %f", s, l)
+	}
+	if s, l := small.score(base, 1), large.score(base, 1); s <= l {
+		t.Errorf("the smaller index scores %f, no better than the larger one's %f", s, l)
+	}
+	if got, want := large.score(base, 1), 0.5-0.1-0.8; got < want-1e-9 || got > want+1e-9 {
+		t.Errorf("score = %f, want %f", got, want)
+	}
+}
+
+func TestSweepWorkloadIsReproducible(t *testing.T) {
+	counts := recordCount{Users: 20, Groups: 5, Members: 2}
+	draw := func() *sweepWorkload {
+		data := &sweepData{counts: counts, userIds: []int64{1, 2, 3}, groupIds: []int64{4, 5}, resIds: []int64{6, 7},
+			rids: []string{"a", "b"}, rng: rand.New(rand.NewSource(7))}
+		return newSweepWorkload(data, 3, 4)
+	}
+	first, second := draw(), draw()
+	if len(first.reads) != 3*len(sweepReads()) || len(first.writes) != 4 {
+		t.Fatalf("drew %d reads and %d writes, want %d and 4", len(first.reads), len(first.writes), 3*len(sweepReads()))
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("workloads drawn from the same seed differ:\n%+v\n%+v", first, second)
+	}
+}
+
+func TestImplicitTxnBackoff(t *testing.T) {
+	for retries, want := range []time.Duration{implicitTxnMinBackoff, 2 * implicitTxnMinBackoff, 4 * implicitTxnMinBackoff} {
+		if got := implicitTxnBackoff(retries); got < want/2 || got > want {
+			t.Errorf("implicitTxnBackoff(%d) = %s, want between %s and %s", retries, got, want/2, want)
+		}
+	}
+	if got := implicitTxnBackoff(100); got < implicitTxnMaxBackoff/2 || got > implicitTxnMaxBackoff {
+		t.Errorf("implicitTxnBackoff(100) = %s, want at most %s", got, implicitTxnMaxBackoff)
+	}
+}
+
+// TestSayDuringLogTiming logs from a background goroutine, like the fault proxy's schedule or the pool
+// statistics reporter, while the foreground nests logTiming calls. Run it with -race.
+func TestSayDuringLogTiming(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ii := 0; ii < 100; ii++ {
+			say("background %d", ii)
+		}
+	}()
+	for ii := 0; ii < 100; ii++ {
+		logTiming("foreground", func() error { return nil })
+	}
+	<-done
+	if depth := logdepth.Load(); depth != 0 {
+		t.Errorf("logdepth is %d after the logTiming calls returned, want 0", depth)
+	}
+}
+
+func TestChurnRateBounds(t *testing.T) {
+	defer func(r int) { churnRate = r }(churnRate)
+	for _, rate := range []int{0, -1, int(time.Second) + 1} {
+		churnRate = rate
+		if err := churnMemberships(nil, 1, 1); err == nil {
+			t.Errorf("churn rate %d accepted", rate)
+		}
+	}
+}
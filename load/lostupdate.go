@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func lostUpdateResourceName(rid int) string { return "lost-update-resource-" + strconv.Itoa(rid) }
+
+func lostUpdateAction(worker, grant int) string { return fmt.Sprintf("w%d-a%d", worker, grant) }
+
+// checkLostUpdates has workers concurrently grant disjoint actions to the same (principal, resource) pairs
+// and then verifies that no grant was lost. Each pair consists of user i or group i and resource i.
+func checkLostUpdates(db *sql.DB, workers, pairs, grants int) (err error) {
+	defer func() {
+		if cerr := removeData(db); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if err := logTimingV("Add principals and resources", func() error {
+		if err := addUsers(db, pairs); err != nil {
+			return err
+		}
+		if err := addGroups(db, pairs); err != nil {
+			return err
+		}
+		for pair := 0; pair < pairs; pair++ {
+			if err := addResource(db, lostUpdateResourceName(pair)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var isolation string
+	if err := executeTx(db, func(tx *txn) error {
+		return tx.Tx.QueryRow("SHOW TRANSACTION ISOLATION LEVEL").Scan(&isolation)
+	}); err != nil {
+		return err
+	}
+
+	// granted holds the grants that succeeded. Only those are expected to be present afterwards;
+	// a grant that failed is reported as a failure rather than as a lost update.
+	type grantKey struct {
+		kind   string
+		pair   int
+		action string
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		granted  = map[grantKey]bool{}
+		failures int
+	)
+	if err := logTiming(fmt.Sprintf("Granting %d actions to %d pairs from %d workers", grants, pairs, workers), func() error {
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for grant := 0; grant < grants; grant++ {
+					action := lostUpdateAction(worker, grant)
+					for pair := 0; pair < pairs; pair++ {
+						resource := lostUpdateResourceName(pair)
+						for _, principal := range []struct {
+							kind  string
+							grant func(db *sql.DB, resource string, pair int, action string) error
+						}{
+							{"user", grantUserAction},
+							{"group", grantGroupAction},
+						} {
+							err := principal.grant(db, resource, pair, action)
+							mu.Lock()
+							if err != nil {
+								say("Worker %d failed to grant %s on %s to %s %d: %v", worker, action, resource, principal.kind, pair, err)
+								failures++
+							} else {
+								granted[grantKey{principal.kind, pair, action}] = true
+							}
+							mu.Unlock()
+						}
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	lost := 0
+	for pair := 0; pair < pairs; pair++ {
+		resource := lostUpdateResourceName(pair)
+		for _, principal := range []struct{ kind, query string }{
+			{"user", "SELECT aces.actions FROM aces JOIN users ON users.id = aces.user_id JOIN resources ON resources.id = aces.resource_id WHERE users.uid = $1 AND resources.rid = $2"},
+			{"group", "SELECT aces.actions FROM aces JOIN groups ON groups.id = aces.group_id JOIN resources ON resources.id = aces.resource_id WHERE groups.gid = $1 AND resources.rid = $2"},
+		} {
+			var actionstr string
+			if err := db.QueryRow(principal.query, strconv.Itoa(pair), resource).Scan(&actionstr); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			present := map[string]bool{}
+			for _, action := range strings.Split(actionstr, ",") {
+				present[action] = true
+			}
+			for worker := 0; worker < workers; worker++ {
+				for g := 0; g < grants; g++ {
+					action := lostUpdateAction(worker, g)
+					if granted[grantKey{principal.kind, pair, action}] && !present[action] {
+						say("Lost grant: %s %d was not granted %s on %s", principal.kind, pair, action, resource)
+						lost++
+					}
+				}
+			}
+		}
+	}
+	total := 2 * pairs * workers * grants
+	say("Lost update check (isolation level %s): %d of %d successful grants lost, %d of %d grants failed",
+		isolation, lost, len(granted), failures, total)
+	if lost > 0 {
+		return fmt.Errorf("%d of %d successful grants were lost under isolation level %s", lost, len(granted), isolation)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const fkSchema = `
+DROP DATABASE IF EXISTS testdb;
+CREATE DATABASE testdb;
+SET DATABASE=testdb;
+
+CREATE TABLE configs (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	key STRING NULL,
+	value STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX configs_key_key (key ASC),
+	FAMILY "primary" (id, key, value)
+);
+
+CREATE TABLE groups (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	gid STRING NULL,
+	description STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX groups_gid_key (gid ASC),
+	FAMILY "primary" (id, gid, description)
+);
+
+CREATE TABLE resources (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	rid STRING NULL,
+	description STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX resources_rid_key (rid ASC),
+	FAMILY "primary" (id, rid, description)
+);
+
+CREATE TABLE users (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	uid STRING NULL,
+	passwordhash STRING NULL,
+	utype STRING(7) NULL,
+	description STRING NULL,
+	is_remote BOOL NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX users_uid_key (uid ASC),
+	FAMILY "primary" (id, uid, passwordhash, utype, description, is_remote),
+	CONSTRAINT usertype CHECK (utype IN ('regular':::STRING, 'service':::STRING))
+);
+
+CREATE TABLE aces (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	user_id INTEGER NULL REFERENCES users (id) ON DELETE CASCADE,
+	group_id INTEGER NULL REFERENCES groups (id) ON DELETE CASCADE,
+	resource_id INTEGER NULL REFERENCES resources (id) ON DELETE CASCADE,
+	actions STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT user_resource_unique UNIQUE (user_id, resource_id),
+	CONSTRAINT group_resource_unique UNIQUE (group_id, resource_id),
+	INDEX aces_resource_id_idx (resource_id ASC),
+	FAMILY "primary" (id, user_id, group_id, resource_id, actions)
+);
+
+CREATE TABLE user_groups (
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	group_id INTEGER NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+	CONSTRAINT "primary" PRIMARY KEY (user_id ASC, group_id ASC),
+	UNIQUE INDEX user_groups_user_id_group_id_key (user_id ASC, group_id ASC),
+	INDEX user_groups_group_id_idx (group_id ASC),
+	FAMILY "primary" (user_id, group_id)
+);
+`
+
+// interleavedSchema stores user_groups rows with the users row they belong to. The aces table keeps its default
+// layout: group-owned aces have a NULL user_id, which can't be part of a primary key, and keying aces by a column
+// derived from user_id would take a computed column, which requires CockroachDB 2.0, or writers that fill it in.
+const interleavedSchema = `
+DROP DATABASE IF EXISTS testdb;
+CREATE DATABASE testdb;
+SET DATABASE=testdb;
+
+CREATE TABLE configs (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	key STRING NULL,
+	value STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX configs_key_key (key ASC),
+	FAMILY "primary" (id, key, value)
+);
+
+CREATE TABLE groups (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	gid STRING NULL,
+	description STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX groups_gid_key (gid ASC),
+	FAMILY "primary" (id, gid, description)
+);
+
+CREATE TABLE resources (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	rid STRING NULL,
+	description STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX resources_rid_key (rid ASC),
+	FAMILY "primary" (id, rid, description)
+);
+
+CREATE TABLE users (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	uid STRING NULL,
+	passwordhash STRING NULL,
+	utype STRING(7) NULL,
+	description STRING NULL,
+	is_remote BOOL NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	UNIQUE INDEX users_uid_key (uid ASC),
+	FAMILY "primary" (id, uid, passwordhash, utype, description, is_remote),
+	CONSTRAINT usertype CHECK (utype IN ('regular':::STRING, 'service':::STRING))
+);
+
+CREATE TABLE aces (
+	id INTEGER NOT NULL DEFAULT unique_rowid(),
+	user_id INTEGER NULL,
+	group_id INTEGER NULL,
+	resource_id INTEGER NULL,
+	actions STRING NULL,
+	CONSTRAINT "primary" PRIMARY KEY (id ASC),
+	CONSTRAINT user_resource_unique UNIQUE (user_id, resource_id),
+	CONSTRAINT group_resource_unique UNIQUE (group_id, resource_id),
+	FAMILY "primary" (id, user_id, group_id, resource_id, actions)
+);
+
+CREATE TABLE user_groups (
+	user_id INTEGER NOT NULL,
+	group_id INTEGER NOT NULL,
+	CONSTRAINT "primary" PRIMARY KEY (user_id ASC, group_id ASC),
+	UNIQUE INDEX user_groups_user_id_group_id_key (user_id ASC, group_id ASC),
+	FAMILY "primary" (user_id, group_id)
+) INTERLEAVE IN PARENT users (user_id);
+`
+
+// withAcesIndexes returns the default schema with the unique constraints on aces replaced by acesIndexes
+// and userGroupsIndexes added to user_groups.
+func withAcesIndexes(acesIndexes, userGroupsIndexes string) string {
+	ddl := strings.Replace(schema, `	CONSTRAINT user_resource_unique UNIQUE (user_id, resource_id),
+	CONSTRAINT group_resource_unique UNIQUE (group_id, resource_id),
+`, acesIndexes, 1)
+	return strings.Replace(ddl, `	UNIQUE INDEX user_groups_user_id_group_id_key (user_id ASC, group_id ASC),
+`, `	UNIQUE INDEX user_groups_user_id_group_id_key (user_id ASC, group_id ASC),
+`+userGroupsIndexes, 1)
+}
+
+// A schemaVariant is an alternative layout of the tables that load and joinquery operate on.
+type schemaVariant struct {
+	ddl string
+	// cascade is true if deleting a user, group or resource also deletes the rows referencing it,
+	// so that removing a record takes a single DELETE.
+	cascade bool
+	// requires names the CockroachDB version the variant needs, if it is newer than 1.0.
+	requires string
+}
+
+var schemaVariants = map[string]schemaVariant{
+	"default": {ddl: schema},
+	// fk adds foreign keys from aces and user_groups to the tables they reference, along with the
+	// indexes foreign keys require. ON DELETE CASCADE requires CockroachDB 2.0 or later.
+	"fk": {ddl: fkSchema, cascade: true, requires: "2.0"},
+	// fk-no-cascade has the same foreign keys without cascading deletes, which CockroachDB 1.0 supports.
+	// Records are removed with the same manual DELETEs as in the default schema.
+	"fk-no-cascade": {ddl: strings.Replace(fkSchema, " ON DELETE CASCADE", "", -1)},
+	// interleaved co-locates memberships with their user.
+	"interleaved": {ddl: interleavedSchema},
+	// indexed adds plain secondary indexes for looking up aces by resource and memberships by group.
+	// Queries that need columns other than the indexed ones and the primary key perform an index join.
+	"indexed": {ddl: withAcesIndexes(`	CONSTRAINT user_resource_unique UNIQUE (user_id, resource_id),
+	CONSTRAINT group_resource_unique UNIQUE (group_id, resource_id),
+	INDEX aces_resource_id_idx (resource_id ASC),
+`, `	INDEX user_groups_group_id_idx (group_id ASC),
+`)},
+	// storing makes the aces indexes covering for the ACL queries in joinquery so that they don't need an index join.
+	"storing": {ddl: withAcesIndexes(`	UNIQUE INDEX user_resource_unique (user_id ASC, resource_id ASC) STORING (group_id, actions),
+	UNIQUE INDEX group_resource_unique (group_id ASC, resource_id ASC) STORING (user_id, actions),
+	INDEX aces_resource_id_idx (resource_id ASC) STORING (user_id, group_id, actions),
+`, `	INDEX user_groups_group_id_idx (group_id ASC),
+`)},
+}
+
+var (
+	schemaName   = "default"
+	activeSchema = schemaVariants["default"]
+)
+
+func selectSchema(name string) error {
+	variant, ok := schemaVariants[name]
+	if !ok {
+		return fmt.Errorf("unknown schema variant %q", name)
+	}
+	schemaName, activeSchema = name, variant
+	return nil
+}
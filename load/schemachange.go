@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/gpaul/cockroachload/chaos"
+)
+
+var (
+	schemaChangeDDL   string
+	schemaChangeAfter time.Duration
+)
+
+// An opSample is the outcome of a single transaction issued by the workload.
+type opSample struct {
+	start time.Time
+	// latency excludes preparing, the time spent preparing statements on first use.
+	latency, preparing time.Duration
+	retries            int
+	err                error
+}
+
+// opRecorder collects the outcome of every transaction while it is installed as an active recorder.
+type opRecorder struct {
+	mu      sync.Mutex
+	samples []opSample
+}
+
+var (
+	recorderMu      sync.Mutex
+	activeRecorders = map[*opRecorder]struct{}{}
+)
+
+func startRecording() *opRecorder {
+	r := &opRecorder{}
+	recorderMu.Lock()
+	activeRecorders[r] = struct{}{}
+	recorderMu.Unlock()
+	return r
+}
+
+func (r *opRecorder) stop() {
+	recorderMu.Lock()
+	delete(activeRecorders, r)
+	recorderMu.Unlock()
+}
+
+func recordOp(sample opSample) {
+	if m := chaosMonkey; m != nil {
+		m.Record(chaos.Sample{Start: sample.start, Latency: sample.latency, Retries: sample.retries, Err: sample.err})
+	}
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	for r := range activeRecorders {
+		r.mu.Lock()
+		r.samples = append(r.samples, sample)
+		r.mu.Unlock()
+	}
+}
+
+// executeTx runs fn in a transaction like crdb.ExecuteTx and records its latency if a recorder is active.
+func executeTx(db *sql.DB, fn func(*txn) error) error {
+	return executeTxApplied(db, nil, fn)
+}
+
+// executeTxApplied is executeTx for a transaction whose retry can tell that an earlier attempt was applied, see runOpApplied.
+func executeTxApplied(db *sql.DB, applied func(error) bool, fn func(*txn) error) error {
+	return runOpApplied(func() (int, time.Duration, error) {
+		attempts := 0
+		var t *txn
+		err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+			attempts++
+			// Retries run in the same transaction, so they can reuse its prepared statements.
+			if t == nil {
+				t = newTxn(db, tx)
+			}
+			return fn(t)
+		})
+		var preparing time.Duration
+		if t != nil {
+			preparing = t.preparing
+		}
+		return attempts - 1, preparing, err
+	}, applied)
+}
+
+// runOp runs op, which returns how often it retried internally and how long it spent preparing statements,
+// and records its outcome. During the chaos phase, an op that fails because a node is down is retried for up to chaosRetryTimeout.
+func runOp(op func() (retries int, preparing time.Duration, err error)) error {
+	return runOpApplied(op, nil)
+}
+
+// runOpApplied is runOp for an op that may have been applied even though it failed because a node went down,
+// e.g. an INSERT whose COMMIT succeeded but whose connection was lost before the reply arrived.
+// If a retry fails with an error for which applied returns true, such as a unique violation, the earlier attempt
+// was applied and the op succeeded.
+func runOpApplied(op func() (retries int, preparing time.Duration, err error), applied func(error) bool) error {
+	for begin, retried := time.Now(), false; ; time.Sleep(chaosRetryBackoff) {
+		start := time.Now()
+		retries, preparing, err := op()
+		if retried && applied != nil && applied(err) {
+			say("Retry failed with %v, so the failed attempt was applied", err)
+			err = nil
+		}
+		recordOp(opSample{start: start, latency: time.Since(start) - preparing, preparing: preparing, retries: retries, err: err})
+		if chaosMonkey == nil || !chaos.Transient(err) || time.Since(begin) > chaosRetryTimeout {
+			return err
+		}
+		retried = true
+	}
+}
+
+// samplesBetween returns the samples that started in [from, to).
+func (r *opRecorder) samplesBetween(from, to time.Time) []opSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []opSample
+	for _, s := range r.samples {
+		if !s.start.Before(from) && s.start.Before(to) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// discardBefore drops the samples that started before t.
+func (r *opRecorder) discardBefore(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.samples[:0]
+	for _, s := range r.samples {
+		if !s.start.Before(t) {
+			kept = append(kept, s)
+		}
+	}
+	r.samples = kept
+}
+
+// summarizeLatencies describes the number of operations, errors and the latency distribution of samples.
+func summarizeLatencies(samples []opSample) string {
+	if len(samples) == 0 {
+		return "no operations"
+	}
+	latencies := make([]time.Duration, len(samples))
+	var total, preparing time.Duration
+	errors := 0
+	for idx, s := range samples {
+		latencies[idx] = s.latency
+		total += s.latency
+		preparing += s.preparing
+		if s.err != nil {
+			errors++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration { return latencies[int(p*float64(len(latencies)-1))] }
+	summary := fmt.Sprintf("%d operations, %d errors, mean %s, p50 %s, p99 %s, max %s",
+		len(samples), errors, total/time.Duration(len(samples)), percentile(0.5), percentile(0.99), latencies[len(latencies)-1])
+	if preparing > 0 {
+		summary += fmt.Sprintf(", plus %s preparing statements", preparing)
+	}
+	return summary
+}
+
+// schemaChangePhase runs a schema change at a fixed offset into a running workload.
+type schemaChangePhase struct {
+	recorder   *opRecorder
+	begin      time.Time
+	start, end time.Time
+	done       chan error
+}
+
+// startSchemaChange records the workload's transactions and launches ddl after delay.
+func startSchemaChange(db *sql.DB, ddl string, delay time.Duration) *schemaChangePhase {
+	p := &schemaChangePhase{recorder: startRecording(), begin: time.Now(), done: make(chan error, 1)}
+	go func() {
+		time.Sleep(delay)
+		p.start = time.Now()
+		say("Starting schema change: %s", ddl)
+		_, err := db.Exec(ddl)
+		p.end = time.Now()
+		p.done <- err
+	}()
+	return p
+}
+
+// wait waits for the schema change to complete and reports the workload's latency before, during and after it.
+func (p *schemaChangePhase) wait() error {
+	err := <-p.done
+	p.recorder.stop()
+	if err != nil {
+		return fmt.Errorf("schema change failed after %s: %v", p.end.Sub(p.start), err)
+	}
+	say("Schema change took %s", p.end.Sub(p.start))
+	say("Workload before schema change: %s", summarizeLatencies(p.recorder.samplesBetween(p.begin, p.start)))
+	say("Workload during schema change: %s", summarizeLatencies(p.recorder.samplesBetween(p.start, p.end)))
+	say("Workload after schema change: %s", summarizeLatencies(p.recorder.samplesBetween(p.end, time.Now())))
+	return nil
+}
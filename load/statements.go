@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// statementMode determines how the statements of the workload's transactions are sent:
+//
+//	adhoc: as a string every time, which lib/pq sends as an unnamed prepare followed by an execute
+//	tx: prepared the first time they are used in a transaction and reused for the rest of it
+//	conn: prepared once per connection and reused by every transaction on it, as an ORM would
+var statementMode = "adhoc"
+
+var statementModes = []string{"adhoc", "tx", "conn"}
+
+func selectStatementMode(mode string) error {
+	for _, m := range statementModes {
+		if m == mode {
+			statementMode = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid statement mode %q: must be one of %v", mode, statementModes)
+}
+
+// txn is a transaction whose Exec, Query and QueryRow send statements according to statementMode.
+// Use the embedded *sql.Tx for statements that can't or shouldn't be prepared, such as DDL.
+type txn struct {
+	*sql.Tx
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+	// preparing is the time spent preparing statements, which the transaction's latency excludes.
+	preparing time.Duration
+}
+
+func newTxn(db *sql.DB, tx *sql.Tx) *txn {
+	return &txn{Tx: tx, db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// stmt returns query prepared for use in tx. The statement is closed when tx ends.
+func (tx *txn) stmt(query string) (*sql.Stmt, error) {
+	if stmt, ok := tx.stmts[query]; ok {
+		return stmt, nil
+	}
+	var stmt *sql.Stmt
+	d, err := timePrepare(func() error {
+		if statementMode == "conn" {
+			dbStmt, err := connStatement(tx.db, query)
+			if err != nil {
+				return err
+			}
+			// database/sql prepares the statement on the transaction's connection unless it already is.
+			stmt = tx.Tx.Stmt(dbStmt)
+			return nil
+		}
+		var err error
+		stmt, err = tx.Tx.Prepare(query)
+		return err
+	})
+	tx.preparing += d
+	if err != nil {
+		return nil, err
+	}
+	tx.stmts[query] = stmt
+	return stmt, nil
+}
+
+var (
+	prepareMu   sync.Mutex
+	prepareTime time.Duration
+)
+
+// timePrepare runs prepare, which prepares a statement, and returns how long it took.
+// Statements are prepared the first time they are used, so the time is excluded from the latency of the
+// operation that used them and reported separately, see takePrepareTime.
+func timePrepare(prepare func() error) (time.Duration, error) {
+	start := time.Now()
+	err := prepare()
+	d := time.Since(start)
+	prepareMu.Lock()
+	prepareTime += d
+	prepareMu.Unlock()
+	return d, err
+}
+
+// takePrepareTime returns the time spent preparing statements since the last call.
+func takePrepareTime() time.Duration {
+	prepareMu.Lock()
+	defer prepareMu.Unlock()
+	d := prepareTime
+	prepareTime = 0
+	return d
+}
+
+func (tx *txn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if statementMode == "adhoc" {
+		return tx.Tx.Exec(query, args...)
+	}
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+func (tx *txn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if statementMode == "adhoc" {
+		return tx.Tx.Query(query, args...)
+	}
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+// txRow is a *sql.Row that can also hold the error of preparing its statement.
+type txRow struct {
+	*sql.Row
+	err error
+}
+
+func (r *txRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Row.Scan(dest...)
+}
+
+func (tx *txn) QueryRow(query string, args ...interface{}) *txRow {
+	if statementMode == "adhoc" {
+		return &txRow{Row: tx.Tx.QueryRow(query, args...)}
+	}
+	stmt, err := tx.stmt(query)
+	if err != nil {
+		return &txRow{err: err}
+	}
+	return &txRow{Row: stmt.QueryRow(args...)}
+}
+
+var (
+	connStmtsMu sync.Mutex
+	connStmts   = map[*sql.DB]map[string]*sql.Stmt{}
+)
+
+// connStatement returns query prepared on db. database/sql prepares it on each connection the first time it is used there.
+func connStatement(db *sql.DB, query string) (*sql.Stmt, error) {
+	connStmtsMu.Lock()
+	defer connStmtsMu.Unlock()
+	stmts, ok := connStmts[db]
+	if !ok {
+		stmts = map[string]*sql.Stmt{}
+		connStmts[db] = stmts
+	}
+	if stmt, ok := stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	stmts[query] = stmt
+	return stmt, nil
+}
+
+// implicitTxns makes execSingle run single-statement operations as implicit transactions.
+var implicitTxns bool
+
+// implicitTxnMaxAttempts bounds how often an implicit transaction is sent before its retryable error is returned.
+const implicitTxnMaxAttempts = 10
+
+var (
+	implicitTxnMinBackoff = 10 * time.Millisecond
+	implicitTxnMaxBackoff = time.Second
+)
+
+// implicitTxnBackoff returns how long to wait before retrying an implicit transaction that failed retries+1 times.
+// The backoff doubles with every retry from implicitTxnMinBackoff up to implicitTxnMaxBackoff and is randomized
+// between half and all of that, so that contending clients don't retry in lockstep.
+func implicitTxnBackoff(retries int) time.Duration {
+	max := implicitTxnMinBackoff << uint(retries)
+	if max <= 0 || max > implicitTxnMaxBackoff {
+		max = implicitTxnMaxBackoff
+	}
+	return max/2 + time.Duration(rand.Int63n(int64(max/2)+1))
+}
+
+// execSingle runs an operation that consists of a single statement.
+// Unless implicitTxns is set, the statement is wrapped in executeTx like every other operation.
+// Otherwise it is sent on its own, saving the BEGIN, SAVEPOINT, RELEASE and COMMIT round trips,
+// and retried on the client with a jittered backoff if it fails with a retryable error, up to implicitTxnMaxAttempts times.
+// In conn mode the statement is prepared once per connection; in tx mode there is no transaction
+// to reuse a prepared statement in, so it is sent ad hoc.
+func execSingle(db *sql.DB, query string, args ...interface{}) error {
+	_, err := execSingleResult(db, query, args...)
+	return err
+}
+
+// execSingleResult is execSingle for callers that need the statement's result.
+func execSingleResult(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	return execSingleApplied(db, nil, query, args...)
+}
+
+// insertRecord runs the INSERT of a user, group or resource, whose string ID is unique, with execSingle.
+// During the chaos phase a retried insert fails with a unique violation if the attempt that lost its
+// connection had been committed, in which case the record was inserted after all.
+func insertRecord(db *sql.DB, query string, args ...interface{}) error {
+	_, err := execSingleApplied(db, uniqueViolation, query, args...)
+	return err
+}
+
+// execSingleApplied is execSingleResult for a statement whose retry can tell that an earlier attempt was applied, see runOpApplied.
+func execSingleApplied(db *sql.DB, applied func(error) bool, query string, args ...interface{}) (result sql.Result, err error) {
+	if !implicitTxns {
+		err = executeTxApplied(db, applied, func(tx *txn) error {
+			result, err = tx.Exec(query, args...)
+			return err
+		})
+		return result, err
+	}
+	err = runOpApplied(func() (int, time.Duration, error) {
+		var preparing time.Duration
+		for retries := 0; ; retries++ {
+			if statementMode == "conn" {
+				var stmt *sql.Stmt
+				// On a connection other than the one it was prepared on, database/sql prepares the statement
+				// again as part of the Exec, which can't be timed separately.
+				d, perr := timePrepare(func() error {
+					var err error
+					stmt, err = connStatement(db, query)
+					return err
+				})
+				preparing += d
+				if err = perr; err == nil {
+					result, err = stmt.Exec(args...)
+				}
+			} else {
+				result, err = db.Exec(query, args...)
+			}
+			if !retryable(err) {
+				return retries, preparing, err
+			}
+			if retries+1 == implicitTxnMaxAttempts {
+				say("Giving up on an implicit transaction after %d attempts: %v", implicitTxnMaxAttempts, err)
+				return retries, preparing, err
+			}
+			time.Sleep(implicitTxnBackoff(retries))
+		}
+	}, applied)
+	return result, err
+}
+
+// retryable reports whether err asks the client to retry the transaction, as crdb.ExecuteTx does.
+func retryable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && (pqErr.Code == "CR000" || pqErr.Code == "40001")
+}
+
+// uniqueViolation reports whether err is a unique constraint violation.
+func uniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
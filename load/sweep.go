@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// recordTypeNames are the names of the RecordTypes as used in flags and log lines.
+var recordTypeNames = [LastRecordType]string{"users", "groups", "members", "user-permissions", "group-permissions"}
+
+// parseRecordTypes parses a comma-separated list of record type names.
+func parseRecordTypes(list string) ([]RecordType, error) {
+	var types []RecordType
+	seen := map[RecordType]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		rt := RecordType(0)
+		for rt < LastRecordType && recordTypeNames[rt] != name {
+			rt++
+		}
+		if rt == LastRecordType {
+			return nil, fmt.Errorf("invalid record type %q: must be one of %v", name, recordTypeNames)
+		}
+		if seen[rt] {
+			return nil, fmt.Errorf("record type %s is listed twice", name)
+		}
+		seen[rt] = true
+		types = append(types, rt)
+	}
+	return types, nil
+}
+
+// sweep describes the record counts run loads, one data point per iteration.
+// The sweep proceeds in rounds, each with a baseline count. Within a round, the participating
+// types start at the baseline and every combination of them is in turn raised to the next round's baseline,
+// so a round has 2^len(types) iterations. Types that don't participate are always 0.
+type sweep struct {
+	types  []RecordType
+	start  int     // the baseline of the first round
+	step   int     // added to the baseline every round, or the minimum increase with growth
+	growth float64 // if greater than 1, the baseline is multiplied by growth every round instead
+	max    int     // no count exceeds max: the last round raises the types to max at most, 0 never ends
+}
+
+func (s sweep) validate() error {
+	if len(s.types) == 0 {
+		return fmt.Errorf("no record types participate")
+	}
+	if s.step <= 0 {
+		return fmt.Errorf("the step must be positive")
+	}
+	if s.start < 0 {
+		return fmt.Errorf("the starting baseline can't be negative")
+	}
+	if s.max != 0 && s.max <= s.start {
+		return fmt.Errorf("the maximum (%d) must be higher than the starting baseline (%d)", s.max, s.start)
+	}
+	return nil
+}
+
+func (s sweep) String() string {
+	var types []string
+	for _, rt := range s.types {
+		types = append(types, recordTypeNames[rt])
+	}
+	growth := fmt.Sprintf("+%d", s.step)
+	if s.growth > 1 {
+		growth = fmt.Sprintf("x%g", s.growth)
+	}
+	limit := "unbounded"
+	if s.max > 0 {
+		limit = fmt.Sprintf("up to %d", s.max)
+	}
+	return fmt.Sprintf("%s from %d %s %s", strings.Join(types, ","), s.start, growth, limit)
+}
+
+// next returns the baseline of the round after the one with the given baseline.
+func (s sweep) next(baseline int) int {
+	if s.growth <= 1 {
+		return baseline + s.step
+	}
+	grown := int(math.Ceil(float64(baseline) * s.growth))
+	if grown < baseline+s.step {
+		return baseline + s.step
+	}
+	return grown
+}
+
+// countsForIteration returns how many records of each RecordType to generate in the given iteration.
+// It does so by treating the participating types as a binary string, where a '1' means 'raise this RecordType
+// to the next baseline' and '0' means 'keep it at the baseline'. An overflow moves on to the next round.
+// The next baseline is clamped to max, and the sweep ends when the baseline reaches max, since the previous
+// round already raised every type to it. ok is false once the sweep is past its last round.
+func (s sweep) countsForIteration(iteration int) (counts recordCount, ok bool) {
+	perRound := 1 << uint(len(s.types))
+	baseline := s.start
+	for round := iteration / perRound; round > 0; round-- {
+		baseline = s.next(baseline)
+		if s.max > 0 && baseline >= s.max {
+			return counts, false
+		}
+	}
+	raised := s.next(baseline)
+	if s.max > 0 && raised > s.max {
+		raised = s.max
+	}
+	pattern := iteration % perRound
+	for i, rt := range s.types {
+		counts[rt] = baseline
+		if pattern&(1<<uint(i)) != 0 {
+			counts[rt] = raised
+		}
+	}
+	return counts, true
+}
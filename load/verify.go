@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+var (
+	verifyData  bool
+	warnOnLeaks bool
+)
+
+// expectedRowCounts returns the number of rows prepareData is expected to produce in each table.
+func expectedRowCounts(counts recordCount) map[string]int {
+	return map[string]int{
+		"users":       counts[Users],
+		"groups":      counts[Groups],
+		"resources":   counts[UserPermissions] + counts[GroupPermissions],
+		"user_groups": counts[Groups] * counts[Members],
+		"aces":        counts[UserPermissions]*counts[Users] + counts[GroupPermissions]*counts[Groups],
+		"configs":     0,
+	}
+}
+
+// orphanChecks count rows that violate an invariant of the data set, keyed by a description of the invariant.
+var orphanChecks = []struct{ desc, query string }{
+	{"user_groups rows referencing a missing user",
+		"SELECT count(*) FROM user_groups LEFT JOIN users ON users.id = user_groups.user_id WHERE users.id IS NULL"},
+	{"user_groups rows referencing a missing group",
+		"SELECT count(*) FROM user_groups LEFT JOIN groups ON groups.id = user_groups.group_id WHERE groups.id IS NULL"},
+	{"aces rows referencing a missing user",
+		"SELECT count(*) FROM aces LEFT JOIN users ON users.id = aces.user_id WHERE aces.user_id IS NOT NULL AND users.id IS NULL"},
+	{"aces rows referencing a missing group",
+		"SELECT count(*) FROM aces LEFT JOIN groups ON groups.id = aces.group_id WHERE aces.group_id IS NOT NULL AND groups.id IS NULL"},
+	{"aces rows referencing a missing resource",
+		"SELECT count(*) FROM aces LEFT JOIN resources ON resources.id = aces.resource_id WHERE resources.id IS NULL"},
+	{"aces rows without a user or group",
+		"SELECT count(*) FROM aces WHERE user_id IS NULL AND group_id IS NULL"},
+}
+
+// verifyDataset checks that the data produced by prepareData matches counts and is internally consistent.
+// Every violation is reported and an error is returned if there were any.
+func verifyDataset(db *sql.DB, counts recordCount) error {
+	var violations []string
+	rows, err := countRows(db)
+	if err != nil {
+		return err
+	}
+	expected := expectedRowCounts(counts)
+	for _, table := range tables {
+		if rows[table] != expected[table] {
+			violations = append(violations, fmt.Sprintf("table %s has %d rows, expected %d", table, rows[table], expected[table]))
+		}
+	}
+	for _, check := range orphanChecks {
+		var n int
+		if err := db.QueryRow(check.query).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			violations = append(violations, fmt.Sprintf("found %d %s", n, check.desc))
+		}
+	}
+	duplicates, err := findDuplicateActions(db)
+	if err != nil {
+		return err
+	}
+	violations = append(violations, duplicates...)
+	for _, v := range violations {
+		say("Verification failed: %s", v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("data verification found %d violations", len(violations))
+	}
+	return nil
+}
+
+var tables = []string{"aces", "configs", "groups", "resources", "user_groups", "users"}
+
+// countRows returns the number of rows in each table of the schema.
+func countRows(db *sql.DB) (map[string]int, error) {
+	result := map[string]int{}
+	for _, table := range tables {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM " + table).Scan(&n); err != nil {
+			return nil, err
+		}
+		result[table] = n
+	}
+	return result, nil
+}
+
+// checkEmpty returns an error naming every table that still contains rows.
+// It is run after removeData so that leftovers don't inflate the next iteration.
+func checkEmpty(db *sql.DB) error {
+	rows, err := countRows(db)
+	if err != nil {
+		return err
+	}
+	var leftovers []string
+	for _, table := range tables {
+		if rows[table] > 0 {
+			leftovers = append(leftovers, fmt.Sprintf("%s: %d", table, rows[table]))
+		}
+	}
+	if len(leftovers) > 0 {
+		return fmt.Errorf("rows left over after removing data (%s)", strings.Join(leftovers, ", "))
+	}
+	return nil
+}
+
+func findDuplicateActions(db *sql.DB) (violations []string, err error) {
+	rows, err := db.Query("SELECT id, actions FROM aces")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var actionstr sql.NullString
+		if err := rows.Scan(&id, &actionstr); err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, action := range strings.Split(actionstr.String, ",") {
+			if seen[action] {
+				violations = append(violations, fmt.Sprintf("ace %d grants %q more than once (actions=%q)", id, action, actionstr.String))
+			}
+			seen[action] = true
+		}
+	}
+	return violations, rows.Err()
+}
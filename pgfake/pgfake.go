@@ -0,0 +1,630 @@
+// Package pgfake implements an in-process server that speaks enough of the
+// PostgreSQL wire protocol for lib/pq's simple and extended query flows.
+// Responses are scripted, which makes it possible to test code that talks to
+// CockroachDB hermetically, including its handling of injected faults such as
+// retryable (40001) errors and dropped connections.
+package pgfake
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Error is an error reported to the client as an ErrorResponse.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%s (SQLSTATE %s)", e.Message, e.Code) }
+
+// errCloseConn is returned by a handler to make the server drop the connection.
+var errCloseConn = &Error{Code: "08006", Message: "connection closed by pgfake"}
+
+// Result is the outcome of executing a statement.
+type Result struct {
+	// Columns are the names of the result columns, or nil if the statement returns no rows.
+	Columns []string
+	// Rows are the result rows. A nil value is sent as NULL, anything else in its fmt.Sprint form.
+	Rows [][]interface{}
+	// Tag is the command tag, e.g. "INSERT 0 1". If empty, it is derived from the statement.
+	Tag string
+}
+
+// A Handler produces the responses to the statements received by a Server.
+// Arguments are passed in text format; a nil argument is NULL.
+type Handler interface {
+	// Describe returns the result columns of query, or nil if it returns no rows.
+	Describe(query string) ([]string, error)
+	// Execute runs query with the given arguments.
+	Execute(query string, args []*string) (*Result, error)
+}
+
+// Server accepts connections on a local TCP port and serves them using its Handler.
+type Server struct {
+	handler Handler
+	ln      net.Listener
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	queries  []string
+	prepared map[string]int
+}
+
+// NewServer starts a server listening on a random local port.
+func NewServer(handler Handler) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{handler: handler, ln: ln, conns: map[net.Conn]bool{}, prepared: map[string]int{}}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string { return s.ln.Addr().String() }
+
+// URL returns a connection string for the server suitable for lib/pq.
+func (s *Server) URL() string {
+	return fmt.Sprintf("postgresql://root@%s/testdb?sslmode=disable", s.Addr())
+}
+
+// Queries returns every statement the server has executed, in order.
+func (s *Server) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Prepared returns how many times each statement was prepared. This includes the unnamed
+// statements lib/pq prepares to send a query with arguments.
+func (s *Server) Prepared() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prepared := map[string]int{}
+	for query, n := range s.prepared {
+		prepared[query] = n
+	}
+	return prepared
+}
+
+// Close stops accepting connections, closes all open connections and waits for them to finish.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+				c.Close()
+			}()
+			sc := &serverConn{server: s, rw: bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), txn: 'I'}
+			sc.run()
+		}()
+	}
+}
+
+func (s *Server) logQuery(query string) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+}
+
+func (s *Server) logPrepare(query string) {
+	s.mu.Lock()
+	s.prepared[query]++
+	s.mu.Unlock()
+}
+
+// A statement is a parsed statement of the extended query protocol.
+type statement struct {
+	query   string
+	nparams int
+}
+
+// A portal is a statement bound to its arguments.
+type portal struct {
+	stmt statement
+	args []*string
+}
+
+type serverConn struct {
+	server     *Server
+	rw         *bufio.ReadWriter
+	txn        byte
+	statements map[string]statement
+	portals    map[string]portal
+	// failed is set after an error in the extended protocol until the next Sync.
+	failed bool
+}
+
+const (
+	protocolVersion = 196608
+	sslRequest      = 80877103
+	cancelRequest   = 80877102
+)
+
+// maxStartupLength and maxMessageLength bound the length fields clients may send,
+// so that a malformed length closes the connection instead of allocating arbitrary amounts of memory.
+const (
+	maxStartupLength = 10000
+	maxMessageLength = 1 << 24
+)
+
+// errMalformed is returned for a message whose fields extend past its end.
+var errMalformed = errors.New("pgfake: malformed message")
+
+func (c *serverConn) run() {
+	if err := c.startup(); err != nil {
+		return
+	}
+	c.statements = map[string]statement{}
+	c.portals = map[string]portal{}
+	for {
+		typ, msg, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if err := c.handle(typ, &reader{buf: msg}); err != nil {
+			return
+		}
+		if err := c.rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *serverConn) startup() error {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint32(header[:4]))
+		if length < len(header) || length > maxStartupLength {
+			return fmt.Errorf("pgfake: invalid startup message length %d", length)
+		}
+		rest := make([]byte, length-len(header))
+		if _, err := io.ReadFull(c.rw, rest); err != nil {
+			return err
+		}
+		switch binary.BigEndian.Uint32(header[4:]) {
+		case sslRequest:
+			c.rw.WriteByte('N')
+			if err := c.rw.Flush(); err != nil {
+				return err
+			}
+			continue
+		case protocolVersion:
+		default:
+			return fmt.Errorf("unsupported startup message")
+		}
+		c.send('R', func(w *writer) { w.int32(0) })
+		for _, kv := range [][2]string{
+			{"server_version", "9.5.0"},
+			{"client_encoding", "UTF8"},
+			{"DateStyle", "ISO"},
+			{"integer_datetimes", "on"},
+		} {
+			c.send('S', func(w *writer) { w.string(kv[0]); w.string(kv[1]) })
+		}
+		c.send('K', func(w *writer) { w.int32(1); w.int32(1) })
+		c.sendReady()
+		return c.rw.Flush()
+	}
+}
+
+func (c *serverConn) readMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	// The length includes itself but not the message type.
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > maxMessageLength {
+		return 0, nil, fmt.Errorf("pgfake: invalid length %d for message type %q", length, header[0])
+	}
+	msg := make([]byte, length-4)
+	if _, err := io.ReadFull(c.rw, msg); err != nil {
+		return 0, nil, err
+	}
+	return header[0], msg, nil
+}
+
+func (c *serverConn) handle(typ byte, r *reader) error {
+	if c.failed && typ != 'S' && typ != 'Q' && typ != 'X' {
+		// The extended protocol discards messages after an error until the next Sync.
+		return nil
+	}
+	switch typ {
+	case 'Q':
+		query := r.string()
+		if r.err != nil {
+			return r.err
+		}
+		return c.simpleQuery(query)
+	case 'P':
+		name, query := r.string(), r.string()
+		if r.err != nil {
+			return r.err
+		}
+		c.statements[name] = statement{query: query, nparams: countParams(query)}
+		c.server.logPrepare(query)
+		c.send('1', nil)
+	case 'B':
+		name, stmtName := r.string(), r.string()
+		for ii, n := 0, r.int16(); ii < n; ii++ {
+			r.int16()
+		}
+		nargs := r.int16()
+		if nargs < 0 {
+			return errMalformed
+		}
+		args := make([]*string, nargs)
+		for ii := range args {
+			if n := r.int32(); n >= 0 {
+				arg := string(r.bytes(n))
+				args[ii] = &arg
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+		stmt, ok := c.statements[stmtName]
+		if !ok {
+			return c.extendedError(&Error{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", stmtName)})
+		}
+		c.portals[name] = portal{stmt: stmt, args: args}
+		c.send('2', nil)
+	case 'D':
+		kind, name := r.byte(), r.string()
+		if r.err != nil {
+			return r.err
+		}
+		var query string
+		if kind == 'S' {
+			stmt, ok := c.statements[name]
+			if !ok {
+				return c.extendedError(&Error{Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", name)})
+			}
+			c.send('t', func(w *writer) {
+				w.int16(stmt.nparams)
+				for ii := 0; ii < stmt.nparams; ii++ {
+					w.int32(oidText)
+				}
+			})
+			query = stmt.query
+		} else {
+			p, ok := c.portals[name]
+			if !ok {
+				return c.extendedError(&Error{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", name)})
+			}
+			query = p.stmt.query
+		}
+		columns, err := c.describe(query)
+		if err != nil {
+			return c.extendedError(err)
+		}
+		if columns == nil {
+			c.send('n', nil)
+		} else {
+			c.sendRowDescription(columns)
+		}
+	case 'E':
+		name := r.string()
+		if r.err != nil {
+			return r.err
+		}
+		p, ok := c.portals[name]
+		if !ok {
+			return c.extendedError(&Error{Code: "34000", Message: fmt.Sprintf("portal %q does not exist", name)})
+		}
+		result, err := c.execute(p.stmt.query, p.args)
+		if err != nil {
+			return c.extendedError(err)
+		}
+		c.sendRows(result)
+		c.sendComplete(p.stmt.query, result)
+	case 'S':
+		c.failed = false
+		c.sendReady()
+	case 'C':
+		kind, name := r.byte(), r.string()
+		if r.err != nil {
+			return r.err
+		}
+		if kind == 'S' {
+			delete(c.statements, name)
+		} else {
+			delete(c.portals, name)
+		}
+		c.send('3', nil)
+	case 'H':
+	case 'X':
+		return io.EOF
+	default:
+		return fmt.Errorf("unsupported message type %q", typ)
+	}
+	return nil
+}
+
+func (c *serverConn) simpleQuery(query string) error {
+	if strings.TrimSpace(query) == "" {
+		c.send('I', nil)
+		c.sendReady()
+		return nil
+	}
+	result, err := c.execute(query, nil)
+	if err == errCloseConn {
+		return err
+	}
+	if err != nil {
+		c.sendError(err)
+	} else {
+		if result.Columns != nil {
+			c.sendRowDescription(result.Columns)
+		}
+		c.sendRows(result)
+		c.sendComplete(query, result)
+	}
+	c.sendReady()
+	return nil
+}
+
+func (c *serverConn) extendedError(err error) error {
+	if err == errCloseConn {
+		return err
+	}
+	c.sendError(err)
+	c.failed = true
+	return nil
+}
+
+func (c *serverConn) describe(query string) ([]string, error) {
+	if isTransactionControl(query) {
+		return nil, nil
+	}
+	return c.server.handler.Describe(query)
+}
+
+// execute runs query through the handler, falling back to built-in transaction control statements,
+// and tracks the transaction status reported in ReadyForQuery.
+func (c *serverConn) execute(query string, args []*string) (*Result, error) {
+	c.server.logQuery(query)
+	keyword := firstKeyword(query)
+	if c.txn == 'E' && keyword != "ROLLBACK" {
+		return nil, &Error{Code: "25P02", Message: "current transaction is aborted, commands ignored until end of transaction block"}
+	}
+	result, err := c.server.handler.Execute(query, args)
+	if isNoRule(err) && isTransactionControl(query) {
+		result, err = &Result{}, nil
+	}
+	if err != nil {
+		if err != errCloseConn && c.txn != 'I' {
+			c.txn = 'E'
+		}
+		return nil, err
+	}
+	switch {
+	case keyword == "BEGIN":
+		c.txn = 'T'
+	case keyword == "COMMIT", keyword == "ROLLBACK" && !strings.Contains(strings.ToUpper(query), " TO "):
+		c.txn = 'I'
+	case keyword == "ROLLBACK":
+		c.txn = 'T'
+	}
+	return result, nil
+}
+
+func (c *serverConn) send(typ byte, fill func(w *writer)) {
+	w := &writer{}
+	if fill != nil {
+		fill(w)
+	}
+	c.rw.WriteByte(typ)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(w.buf)+4))
+	c.rw.Write(length[:])
+	c.rw.Write(w.buf)
+}
+
+func (c *serverConn) sendReady() {
+	c.send('Z', func(w *writer) { w.byte(c.txn) })
+}
+
+func (c *serverConn) sendError(err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: "XX000", Message: err.Error()}
+	}
+	c.send('E', func(w *writer) {
+		w.byte('S')
+		w.string("ERROR")
+		w.byte('C')
+		w.string(e.Code)
+		w.byte('M')
+		w.string(e.Message)
+		w.byte(0)
+	})
+}
+
+const oidText = 25
+
+func (c *serverConn) sendRowDescription(columns []string) {
+	c.send('T', func(w *writer) {
+		w.int16(len(columns))
+		for _, col := range columns {
+			w.string(col)
+			w.int32(0)       // table oid
+			w.int16(0)       // attribute number
+			w.int32(oidText) // type oid
+			w.int16(-1)      // type length
+			w.int32(-1)      // type modifier
+			w.int16(0)       // text format
+		}
+	})
+}
+
+func (c *serverConn) sendRows(result *Result) {
+	for _, row := range result.Rows {
+		c.send('D', func(w *writer) {
+			w.int16(len(row))
+			for _, v := range row {
+				if v == nil {
+					w.int32(-1)
+					continue
+				}
+				s := fmt.Sprint(v)
+				w.int32(len(s))
+				w.buf = append(w.buf, s...)
+			}
+		})
+	}
+}
+
+func (c *serverConn) sendComplete(query string, result *Result) {
+	tag := result.Tag
+	if tag == "" {
+		tag = defaultTag(query, result)
+	}
+	c.send('C', func(w *writer) { w.string(tag) })
+}
+
+// defaultTag derives the command tag lib/pq expects from the statement and its result.
+func defaultTag(query string, result *Result) string {
+	keyword := firstKeyword(query)
+	switch keyword {
+	case "SELECT", "SHOW", "EXPLAIN":
+		return fmt.Sprintf("SELECT %d", len(result.Rows))
+	case "INSERT", "UPSERT":
+		return "INSERT 0 1"
+	case "UPDATE", "DELETE":
+		return keyword + " 1"
+	case "RELEASE":
+		return "RELEASE"
+	}
+	return keyword
+}
+
+func firstKeyword(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToUpper(fields[0]), ";")
+}
+
+func isTransactionControl(query string) bool {
+	switch firstKeyword(query) {
+	case "BEGIN", "COMMIT", "ROLLBACK", "SAVEPOINT", "RELEASE":
+		return true
+	}
+	return false
+}
+
+var paramRE = regexp.MustCompile(`\$(\d+)`)
+
+// countParams returns the highest placeholder number used in query.
+func countParams(query string) int {
+	n := 0
+	for _, m := range paramRE.FindAllStringSubmatch(query, -1) {
+		if i, _ := strconv.Atoi(m[1]); i > n {
+			n = i
+		}
+	}
+	return n
+}
+
+type writer struct{ buf []byte }
+
+func (w *writer) byte(b byte) { w.buf = append(w.buf, b) }
+
+func (w *writer) int16(n int) { w.buf = append(w.buf, byte(n>>8), byte(n)) }
+
+func (w *writer) int32(n int) {
+	w.buf = append(w.buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (w *writer) string(s string) { w.buf = append(append(w.buf, s...), 0) }
+
+// reader decodes the fields of a message. Reading past the end of the message sets err
+// and returns zero values from then on.
+type reader struct {
+	buf []byte
+	err error
+}
+
+// take consumes the next n bytes, or returns nil if the message is too short.
+func (r *reader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) int16() int {
+	if b := r.take(2); b != nil {
+		return int(int16(binary.BigEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (r *reader) int32() int {
+	if b := r.take(4); b != nil {
+		return int(int32(binary.BigEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (r *reader) bytes(n int) []byte { return r.take(n) }
+
+func (r *reader) string() string {
+	idx := strings.IndexByte(string(r.buf), 0)
+	if r.err != nil || idx < 0 {
+		r.err = errMalformed
+		return ""
+	}
+	return string(r.take(idx + 1)[:idx])
+}
@@ -0,0 +1,218 @@
+package pgfake
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/lib/pq"
+)
+
+func newTestDB(t *testing.T, rules ...Rule) (*sql.DB, *Server, *Script) {
+	script := NewScript(rules...)
+	server, err := NewServer(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", server.URL())
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return db, server, script
+}
+
+func closeAll(db *sql.DB, server *Server) {
+	db.Close()
+	server.Close()
+}
+
+func TestSimpleQuery(t *testing.T) {
+	db, server, _ := newTestDB(t,
+		Rule{Pattern: `^SELECT uid from users$`, Result: Result{Columns: []string{"uid"}, Rows: [][]interface{}{{"0"}, {"1"}, {nil}}}},
+		Rule{Pattern: `^CREATE TABLE`},
+	)
+	defer closeAll(db, server)
+
+	if _, err := db.Exec("CREATE TABLE t (x INT)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT uid from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []sql.NullString
+	for rows.Next() {
+		var uid sql.NullString
+		if err := rows.Scan(&uid); err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, uid)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 3 || uids[0].String != "0" || uids[1].String != "1" || uids[2].Valid {
+		t.Errorf("got uids %v", uids)
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	db, server, _ := newTestDB(t,
+		Rule{Pattern: `SELECT id from users where users.uid = \$1`, Result: Result{Columns: []string{"id"}, Rows: [][]interface{}{{42}}}},
+		Rule{Pattern: `^INSERT INTO users`},
+	)
+	defer closeAll(db, server)
+
+	var id int64
+	if err := db.QueryRow("SELECT id from users where users.uid = $1", "7").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Errorf("got id %d, want 42", id)
+	}
+	res, err := db.Exec("INSERT INTO users (uid, description) VALUES ($1, $2)", "7", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		t.Errorf("RowsAffected() = %d, %v", n, err)
+	}
+	if prepared := server.Prepared(); len(prepared) != 2 || prepared["SELECT id from users where users.uid = $1"] != 1 {
+		t.Errorf("Prepared() = %v, want each statement once", prepared)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db, server, _ := newTestDB(t,
+		Rule{Pattern: `^SELECT 1`, Err: &Error{Code: "42P01", Message: "table does not exist"}},
+	)
+	defer closeAll(db, server)
+
+	for _, query := range []func() error{
+		func() error { _, err := db.Exec("SELECT 1"); return err },
+		func() error { _, err := db.Exec("SELECT 1 WHERE $1", true); return err },
+	} {
+		err := query()
+		if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "42P01" {
+			t.Errorf("got error %v, want 42P01", err)
+		}
+	}
+	if _, err := db.Exec("SELECT 2"); err == nil {
+		t.Error("unscripted statement succeeded")
+	}
+	// The connection is still usable after errors.
+	if _, err := db.Exec("SELECT 1 WHERE $1", true); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	db, server, script := newTestDB(t,
+		Rule{Pattern: `^UPDATE aces`, Err: &Error{Code: "40001", Message: "restart transaction"}, Times: 2},
+		Rule{Pattern: `^UPDATE aces`},
+	)
+	defer closeAll(db, server)
+
+	attempts := 0
+	if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
+		attempts++
+		_, err := tx.Exec("UPDATE aces SET actions = $1 WHERE aces.id=$2", "read", 1)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("transaction ran %d times, want 3", attempts)
+	}
+	if unused := script.Unused(); len(unused) > 0 {
+		t.Errorf("unused rules: %v", unused)
+	}
+	rollbacks := 0
+	for _, q := range server.Queries() {
+		if q == "ROLLBACK TO SAVEPOINT cockroach_restart" {
+			rollbacks++
+		}
+	}
+	if rollbacks != 2 {
+		t.Errorf("saw %d rollbacks to savepoint, want 2", rollbacks)
+	}
+}
+
+func TestAbortedTransaction(t *testing.T) {
+	db, server, _ := newTestDB(t,
+		Rule{Pattern: `^DELETE`, Err: &Error{Code: "23503", Message: "foreign key violation"}},
+		Rule{Pattern: `^SELECT`, Result: Result{Columns: []string{"n"}, Rows: [][]interface{}{{1}}}},
+	)
+	defer closeAll(db, server)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM users"); err == nil {
+		t.Fatal("expected an error")
+	}
+	err = tx.QueryRow("SELECT 1").Scan(new(int))
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "25P02" {
+		t.Errorf("got error %v in aborted transaction, want 25P02", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseConn(t *testing.T) {
+	db, server, _ := newTestDB(t,
+		Rule{Pattern: `^SELECT`, CloseConn: true, Times: 1},
+		Rule{Pattern: `^SELECT`, Result: Result{Columns: []string{"n"}, Rows: [][]interface{}{{1}}}},
+	)
+	defer closeAll(db, server)
+
+	var n int
+	// database/sql retries statements that fail with driver.ErrBadConn on a new connection.
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d, want 1", n)
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	db, server, _ := newTestDB(t, Rule{Pattern: `^SELECT`, Result: Result{Columns: []string{"n"}, Rows: [][]interface{}{{1}}}})
+	defer closeAll(db, server)
+
+	// A StartupMessage for protocol 3.0 with user=root.
+	startup := []byte{0, 0, 0, 18, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'r', 'o', 'o', 't', 0, 0}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"startup length shorter than its header", []byte{0, 0, 0, 4, 0, 3, 0, 0}},
+		{"startup length too long", []byte{0xff, 0xff, 0xff, 0xff, 0, 3, 0, 0}},
+		{"message length shorter than itself", append(startup, 'Q', 0, 0, 0, 2)},
+		{"message length too long", append(startup, 'Q', 0xff, 0xff, 0xff, 0xff)},
+		{"bind without parameter counts", append(startup, 'B', 0, 0, 0, 6, 0, 0)},
+		{"query without terminator", append(startup, 'Q', 0, 0, 0, 5, 'S')},
+	} {
+		conn, err := net.Dial("tcp", server.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(tc.data); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// The server closes the connection rather than waiting for more data or crashing.
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Fatalf("query after the malformed messages: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package pgfake
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// A Rule scripts the response to the statements matching Pattern.
+type Rule struct {
+	// Pattern is a regular expression matched against the statement text.
+	Pattern string
+	// Result is returned when the rule applies and Err is nil.
+	Result Result
+	// Err, if set, is returned instead of Result, e.g. &Error{Code: "40001"} to force a transaction retry.
+	Err error
+	// CloseConn makes the server drop the connection instead of responding.
+	CloseConn bool
+	// Times limits how often the rule applies; 0 means it always applies.
+	Times int
+
+	re   *regexp.Regexp
+	used int
+}
+
+// Script is a Handler that responds with the first applicable Rule that matches a statement.
+// Transaction control statements (BEGIN, SAVEPOINT, RELEASE, COMMIT, ROLLBACK) succeed
+// unless a rule matches them.
+type Script struct {
+	mu    sync.Mutex
+	rules []*Rule
+}
+
+// NewScript compiles the rules into a Script. It panics if a pattern is invalid.
+func NewScript(rules ...Rule) *Script {
+	s := &Script{}
+	s.Add(rules...)
+	return s
+}
+
+// Add appends rules to the script. Rules added earlier take precedence.
+func (s *Script) Add(rules ...Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range rules {
+		rule := rule
+		rule.re = regexp.MustCompile(rule.Pattern)
+		s.rules = append(s.rules, &rule)
+	}
+}
+
+// Unused returns the patterns of the rules with a limited number of applications that weren't all used.
+func (s *Script) Unused() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unused []string
+	for _, rule := range s.rules {
+		if rule.Times > 0 && rule.used < rule.Times {
+			unused = append(unused, rule.Pattern)
+		}
+	}
+	return unused
+}
+
+func (s *Script) match(query string, consume bool) *Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range s.rules {
+		if rule.Times > 0 && rule.used >= rule.Times {
+			continue
+		}
+		if rule.re.MatchString(query) {
+			if consume {
+				rule.used++
+			}
+			return rule
+		}
+	}
+	return nil
+}
+
+// errNoRule is returned for statements that no rule matches.
+type errNoRule struct{ query string }
+
+func (e errNoRule) Error() string { return fmt.Sprintf("pgfake: no rule matches %q", e.query) }
+
+func isNoRule(err error) bool {
+	_, ok := err.(errNoRule)
+	return ok
+}
+
+// Describe implements Handler.
+func (s *Script) Describe(query string) ([]string, error) {
+	rule := s.match(query, false)
+	if rule == nil {
+		return nil, errNoRule{query}
+	}
+	return rule.Result.Columns, nil
+}
+
+// Execute implements Handler.
+func (s *Script) Execute(query string, args []*string) (*Result, error) {
+	rule := s.match(query, true)
+	if rule == nil {
+		return nil, errNoRule{query}
+	}
+	if rule.CloseConn {
+		return nil, errCloseConn
+	}
+	if rule.Err != nil {
+		return nil, rule.Err
+	}
+	result := rule.Result
+	return &result, nil
+}
@@ -0,0 +1,83 @@
+// Package pool configures the connection pool of a database/sql database and
+// periodically reports its statistics, so that latency caused by waiting for
+// a connection can be told apart from latency in the database.
+package pool
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Config is the size and connection lifetime of a pool.
+type Config struct {
+	// MaxOpen is the maximum number of open connections, 0 for unlimited.
+	MaxOpen int
+	// MaxIdle is the maximum number of idle connections, 0 or less to keep none.
+	MaxIdle int
+	// MaxLifetime is how long a connection may be reused, 0 for forever.
+	MaxLifetime time.Duration
+}
+
+// Apply configures db's pool.
+func (c Config) Apply(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpen)
+	db.SetMaxIdleConns(c.MaxIdle)
+	db.SetConnMaxLifetime(c.MaxLifetime)
+}
+
+func (c Config) String() string {
+	open := "unlimited"
+	if c.MaxOpen > 0 {
+		open = fmt.Sprint(c.MaxOpen)
+	}
+	lifetime := "unlimited"
+	if c.MaxLifetime > 0 {
+		lifetime = c.MaxLifetime.String()
+	}
+	return fmt.Sprintf("max open %s, max idle %d, max lifetime %s", open, c.MaxIdle, lifetime)
+}
+
+// Describe summarizes cur, with the waits and closed connections since prev.
+func Describe(prev, cur sql.DBStats) string {
+	waits := cur.WaitCount - prev.WaitCount
+	s := fmt.Sprintf("%d open (%d in use, %d idle), %d waits", cur.OpenConnections, cur.InUse, cur.Idle, waits)
+	if waits > 0 {
+		wait := cur.WaitDuration - prev.WaitDuration
+		s += fmt.Sprintf(" for %s (mean %s)", wait, wait/time.Duration(waits))
+	}
+	closed := (cur.MaxIdleClosed - prev.MaxIdleClosed) + (cur.MaxIdleTimeClosed - prev.MaxIdleTimeClosed) + (cur.MaxLifetimeClosed - prev.MaxLifetimeClosed)
+	if closed > 0 {
+		s += fmt.Sprintf(", %d closed (%d over max idle, %d idle too long, %d over max lifetime)",
+			closed, cur.MaxIdleClosed-prev.MaxIdleClosed, cur.MaxIdleTimeClosed-prev.MaxIdleTimeClosed, cur.MaxLifetimeClosed-prev.MaxLifetimeClosed)
+	}
+	return s
+}
+
+// Report logs db's pool statistics with logf every interval until stop is called.
+// Each report covers the waits since the previous one; stop logs a final report covering the whole run.
+func Report(db *sql.DB, interval time.Duration, logf func(format string, args ...interface{})) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		prev := db.Stats()
+		for {
+			select {
+			case <-ticker.C:
+				cur := db.Stats()
+				logf("Connection pool: %s in the last %s", Describe(prev, cur), interval)
+				prev = cur
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		logf("Connection pool: %s in total", Describe(sql.DBStats{}, db.Stats()))
+	}
+}
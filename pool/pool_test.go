@@ -0,0 +1,87 @@
+package pool
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gpaul/cockroachload/pgfake"
+	_ "github.com/lib/pq"
+)
+
+func TestConfigString(t *testing.T) {
+	if got, want := (Config{MaxIdle: 2}).String(), "max open unlimited, max idle 2, max lifetime unlimited"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := (Config{MaxOpen: 10, MaxIdle: 5, MaxLifetime: time.Minute}).String(), "max open 10, max idle 5, max lifetime 1m0s"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	prev := sql.DBStats{WaitCount: 10, WaitDuration: time.Second, MaxLifetimeClosed: 1}
+	cur := sql.DBStats{OpenConnections: 4, InUse: 3, Idle: 1, WaitCount: 14, WaitDuration: 3 * time.Second, MaxIdleClosed: 1, MaxLifetimeClosed: 3}
+	want := "4 open (3 in use, 1 idle), 4 waits for 2s (mean 500ms), 3 closed (1 over max idle, 0 idle too long, 2 over max lifetime)"
+	if got := Describe(prev, cur); got != want {
+		t.Errorf("Describe() = %q, want %q", got, want)
+	}
+	if got, want := Describe(cur, cur), "4 open (3 in use, 1 idle), 0 waits"; got != want {
+		t.Errorf("Describe() = %q, want %q", got, want)
+	}
+}
+
+func TestReportCountsWaits(t *testing.T) {
+	server, err := pgfake.NewServer(pgfake.NewScript(pgfake.Rule{Pattern: "^SELECT", Result: pgfake.Result{Columns: []string{"one"}, Rows: [][]interface{}{{1}}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	db, err := sql.Open("postgres", server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	Config{MaxOpen: 1, MaxIdle: 1}.Apply(db)
+
+	var mu sync.Mutex
+	var reports []string
+	stop := Report(db, 10*time.Millisecond, func(format string, args ...interface{}) {
+		mu.Lock()
+		reports = append(reports, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	})
+	// Hold the only connection so that the queries have to wait for it.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for ii := 0; ii < 3; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var one int
+			if err := db.QueryRow("SELECT 1").Scan(&one); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) < 2 {
+		t.Fatalf("got %d reports, want at least 2", len(reports))
+	}
+	if final := reports[len(reports)-1]; !strings.HasPrefix(final, "Connection pool: 1 open (0 in use, 1 idle), 3 waits for ") || !strings.HasSuffix(final, " in total") {
+		t.Errorf("unexpected final report %q", final)
+	}
+}
@@ -0,0 +1,18 @@
+// Package queries holds the ACL queries issued by joinquery, so that the index sweep in load
+// measures exactly the statements joinquery runs.
+package queries
+
+// UserACL fetches every ACE of the user with uid $1, along with the resource it grants access to.
+const UserACL = "SELECT resources.id AS resources_id, resources.rid AS resources_rid, resources.description AS resources_description, aces.actions AS aces_actions, aces.id AS aces_id, aces.user_id AS aces_user_id, aces.group_id AS aces_group_id, aces.resource_id AS aces_resource_id FROM aces JOIN users ON users.id = aces.user_id JOIN resources ON resources.id = aces.resource_id WHERE users.uid = $1"
+
+// CheckAccess fetches the actions the user with uid $1 is granted on the resource with rid $2,
+// either directly or through one of the user's groups.
+const CheckAccess = `SELECT aces.actions FROM aces JOIN users ON users.id = aces.user_id JOIN resources ON resources.id = aces.resource_id WHERE users.uid = $1 AND resources.rid = $2
+UNION ALL
+SELECT aces.actions FROM aces JOIN user_groups ON user_groups.group_id = aces.group_id JOIN users ON users.id = user_groups.user_id JOIN resources ON resources.id = aces.resource_id WHERE users.uid = $1 AND resources.rid = $2`
+
+// ResourcePrincipals lists every user and group with access to the resource with rid $1,
+// expanding group grants to the members of the group.
+const ResourcePrincipals = `SELECT users.uid AS uid, '' AS gid, aces.actions AS actions FROM aces JOIN resources ON resources.id = aces.resource_id JOIN users ON users.id = aces.user_id WHERE resources.rid = $1
+UNION ALL
+SELECT users.uid AS uid, groups.gid AS gid, aces.actions AS actions FROM aces JOIN resources ON resources.id = aces.resource_id JOIN groups ON groups.id = aces.group_id LEFT JOIN user_groups ON user_groups.group_id = aces.group_id LEFT JOIN users ON users.id = user_groups.user_id WHERE resources.rid = $1`